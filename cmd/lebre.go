@@ -4,11 +4,26 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"lebre/internal"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+// serve runs server until it is interrupted or terminated, stopping it cleanly so
+// its last backup is written
+func serve(server *internal.LebreServer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Stop()
+	}()
+	server.Start()
+}
+
 func main() {
 	cli := internal.NewCli()
 	arguments := os.Args[1:]
@@ -86,7 +101,7 @@ func main() {
 		}
 
 		cli.Input(
-			fmt.Sprintf("Cached value lifetime in milliseconds (DEFAULT %d)", serverConfig.PoolConfig.TimeToLive),
+			fmt.Sprintf("Cached value lifetime in seconds (DEFAULT %d)", serverConfig.PoolConfig.TimeToLive),
 			serverConfig.PoolConfig.TimeToLive,
 		)
 		cli.Input(
@@ -101,6 +116,10 @@ func main() {
 			fmt.Sprintf("Cache limit in bytes (DEFAULT %d)", serverConfig.PoolConfig.CacheLimit),
 			serverConfig.PoolConfig.CacheLimit,
 		)
+		cli.Input(
+			fmt.Sprintf("Eviction policy (DEFAULT %s)", serverConfig.PoolConfig.EvictionPolicy),
+			&serverConfig.PoolConfig.EvictionPolicy,
+		)
 
 		userHash := sha256.Sum256([]byte(serverConfig.User))
 		serverConfig.User = hex.EncodeToString(userHash[:])
@@ -120,6 +139,49 @@ func main() {
 			return
 		}
 
+		err = internal.GenerateIdentityKey(serverConfig.IdentityKeyFile)
+		if errors.Is(err, os.ErrExist) {
+			cli.Highlight(fmt.Sprintf("\n Keeping the existing identity key %s", serverConfig.IdentityKeyFile))
+		} else if err != nil {
+			fmt.Println("Error generating identity key: ", err)
+			return
+		}
+
+		identityKey, err := internal.LoadIdentityKey(serverConfig.IdentityKeyFile)
+		if err != nil {
+			fmt.Println("Error reading identity key: ", err)
+			return
+		}
+		cli.Highlight(fmt.Sprintf("\n Server fingerprint: %s\n", internal.Fingerprint(identityKey)))
+
+		return
+
+	case "fingerprint":
+		serverConfig := internal.DefaultServerConfig()
+		configPath := "config.json"
+		if len(arguments) == 3 && (arguments[1] == "--config" || arguments[1] == "-c") {
+			configPath = arguments[2]
+		} else if len(arguments) != 1 {
+			cli.Error(fmt.Sprintf("Invalid argument or command part '%s'", arguments[1]))
+			os.Exit(1)
+		}
+
+		fileData, err := os.ReadFile(configPath)
+		if err != nil {
+			fmt.Println("Error reading JSON file: ", err)
+			return
+		}
+		err = json.Unmarshal(fileData, serverConfig)
+		if err != nil {
+			fmt.Println("Error unmarshalling JSON: ", err)
+			return
+		}
+
+		identityKey, err := internal.LoadIdentityKey(serverConfig.IdentityKeyPath())
+		if err != nil {
+			cli.Fatal(err)
+		}
+		fmt.Println(internal.Fingerprint(identityKey))
 		return
 
 	case "start":
@@ -138,7 +200,7 @@ func main() {
 					return
 				}
 
-				server.Start()
+				serve(server)
 
 			} else {
 				cli.Error(fmt.Sprintf("Invalid argument or command part '%s'", arguments[1]))
@@ -158,7 +220,7 @@ func main() {
 			return
 		}
 
-		server.Start()
+		serve(server)
 
 	// case "config":
 	// 	if len(arguments) != 3 {
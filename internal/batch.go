@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// GetMany returns the value of every key, found reports which keys exist.
+func (cache *cache) GetMany(keys []string) ([][]byte, []bool) {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		shard := cache.shardFor(key)
+		node, ok := shard.lookup(key, now)
+		// keys holding another kind of value read as missing
+		if ok && node.Kind == stringKind {
+			shard.policy.access(key)
+			values[i], found[i] = node.Value, true
+		}
+	}
+	return values, found
+}
+
+// SetMany stores every value under the key at the same index with the default time to live.
+// Either every key is written or, if any limit can't be met, none is.
+func (cache *cache) SetMany(keys []string, values [][]byte) error {
+	for i, key := range keys {
+		err := cache.checkNodeSize(key, values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	expiry := expiryFrom(now, cache.defaultTimeToLive())
+
+	// a key repeated in the batch keeps its last value
+	batches := make(map[*cacheShard]map[string]cacheNode)
+	for i, key := range keys {
+		shard := cache.shardFor(key)
+		if batches[shard] == nil {
+			batches[shard] = make(map[string]cacheNode)
+		}
+		batches[shard][key] = cacheNode{Value: values[i], Expiry: expiry}
+	}
+
+	// nothing is evicted unless every shard can make room
+	for shard, batch := range batches {
+		err := shard.canReserve(batch, now)
+		if err != nil {
+			return err
+		}
+	}
+	for shard, batch := range batches {
+		err := shard.reserve(batch, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	for shard, batch := range batches {
+		for key, node := range batch {
+			// room was reserved above, so this can't evict or fail
+			err := shard.put(key, node)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// batchUsage returns the nodes and bytes the shard would hold once batch is written.
+// Must be called with the write lock held.
+func (shard *cacheShard) batchUsage(batch map[string]cacheNode, now time.Time) (int, uint64) {
+	nodes, bytes := len(shard.Data), uint64(shard.CumulativeBytes)
+	for key, node := range batch {
+		bytes += uint64(node.byteSize(key))
+		if stored, ok := shard.lookup(key, now); ok {
+			bytes -= uint64(stored.size)
+		} else {
+			nodes++
+		}
+	}
+	return nodes, bytes
+}
+
+// limitError is the error of a shard that can't hold nodes and bytes
+func (shard *cacheShard) limitError(nodes int, bytes uint64) error {
+	if nodes > int(shard.Capacity) {
+		return fmt.Errorf("cache node limit exceeded. Max is: %d", shard.cache.Capacity)
+	}
+	if bytes > uint64(shard.LimitInBytes) {
+		return fmt.Errorf("cache byte limit exceeded. Max is: %d", shard.cache.LimitInBytes)
+	}
+	return nil
+}
+
+// canReserve returns the error reserve would fail with, without evicting
+// anything: batch fits if evicting every evictable key outside of it is enough.
+// Must be called with the write lock held.
+func (shard *cacheShard) canReserve(batch map[string]cacheNode, now time.Time) error {
+	nodes, bytes := shard.batchUsage(batch, now)
+	if shard.limitError(nodes, bytes) == nil {
+		return nil
+	}
+
+	// evicting a key of the batch frees nothing, it is written back right after
+	for key, node := range shard.Data {
+		if _, ok := batch[key]; !ok && shard.policy.evictable(key) {
+			nodes--
+			bytes -= uint64(node.size)
+		}
+	}
+	return shard.limitError(nodes, bytes)
+}
+
+// reserve evicts keys until every node in batch fits in the shard limits.
+// Must be called with the write lock held.
+func (shard *cacheShard) reserve(batch map[string]cacheNode, now time.Time) error {
+	for {
+		nodes, bytes := shard.batchUsage(batch, now)
+		err := shard.limitError(nodes, bytes)
+		if err == nil {
+			return nil
+		}
+		if !shard.evict() {
+			return err
+		}
+	}
+}
+
+// DeleteMany removes every key and returns how many existed.
+func (cache *cache) DeleteMany(keys []string) int {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	deleted := 0
+	for _, key := range keys {
+		shard := cache.shardFor(key)
+		if _, ok := shard.lookup(key, now); ok {
+			shard.remove(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Exists counts how many of keys exist, a key given twice is counted twice.
+func (cache *cache) Exists(keys []string) int {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	count := 0
+	for _, key := range keys {
+		if _, ok := cache.shardFor(key).lookup(key, now); ok {
+			count++
+		}
+	}
+	return count
+}
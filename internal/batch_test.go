@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// keysInShard returns count keys held by the shard at index
+func keysInShard(cache *cache, index, count int, prefix string) []string {
+	keys := make([]string, 0, count)
+	for i := 0; len(keys) < count; i++ {
+		key := fmt.Sprintf("%s:%d", prefix, i)
+		if cache.shardFor(key) == cache.shards[index] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestSetManyIsAllOrNothing(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 2
+		config.NodeLimit = 2 * minNodesPerShard
+		config.TimeToLive = 0
+		config.EvictionPolicy = "volatile-lru"
+	})
+
+	// the first shard is full of evictable keys, the second of keys that can't be evicted
+	volatile := keysInShard(cache, 0, minNodesPerShard, "volatile")
+	for _, key := range volatile {
+		cache.Set(key, []byte("value"), time.Hour)
+	}
+	for _, key := range keysInShard(cache, 1, minNodesPerShard, "persistent") {
+		cache.Set(key, []byte("value"), 0)
+	}
+
+	keys := append(keysInShard(cache, 0, 1, "new"), keysInShard(cache, 1, 1, "new")...)
+	for range 10 {
+		err := cache.SetMany(keys, [][]byte{[]byte("a"), []byte("b")})
+		if err == nil {
+			t.Fatal("a batch that can't fit in the second shard was written")
+		}
+	}
+
+	for _, key := range volatile {
+		if _, ok, _ := cache.Get(key); !ok {
+			t.Fatalf("%s was evicted by a batch that failed", key)
+		}
+	}
+	if _, found := cache.GetMany(keys); found[0] || found[1] {
+		t.Error("part of a failed batch was written")
+	}
+}
+
+func TestSetManyEvictsToFit(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 1
+		config.NodeLimit = minNodesPerShard
+		config.TimeToLive = 0
+	})
+	for i := range minNodesPerShard {
+		cache.Set(fmt.Sprintf("old:%d", i), []byte("value"), 0)
+	}
+
+	keys := []string{"new:1", "new:2", "new:1"}
+	err := cache.SetMany(keys, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, found := cache.GetMany(keys[:2])
+	if !found[0] || !found[1] || string(values[0]) != "c" || string(values[1]) != "b" {
+		t.Errorf("got %q %v", values, found)
+	}
+	if size := cache.Size(); size != minNodesPerShard {
+		t.Errorf("the shard holds %d keys", size)
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	// Filters created by BF.ADD hold 100 items at a 1% false positive rate
+	defaultBloomErrorRate = 0.01
+	defaultBloomCapacity  = 100
+)
+
+var errBloomExists = errors.New("item exists")
+
+// Bloom filter nodes keep the number of hash functions in the first byte of
+// Bits, followed by the bit array.
+
+// bloomSize returns the bytes of the bit array and the number of hash functions
+// of a filter holding capacity items at errorRate false positives.
+func bloomSize(errorRate float64, capacity uint64) (int, int) {
+	bits := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Round(bits / float64(capacity) * math.Ln2)
+	// a filter too large for an int could never fit under the node size limit anyway
+	return int(min(math.Ceil(bits/8), math.MaxInt32)), int(min(max(hashes, 1), math.MaxUint8))
+}
+
+func newBloomNode(bytes, hashes int, expiry time.Time) cacheNode {
+	bits := make([]byte, 1+bytes)
+	bits[0] = byte(hashes)
+	return cacheNode{Kind: bloomKind, Bits: bits, Expiry: expiry}
+}
+
+// bloomMissing returns the positions of the bits of item not set in filter yet.
+// They are derived from two hashes of item by double hashing.
+func bloomMissing(filter []byte, item string) []uint64 {
+	data := filter[1:]
+	size := uint64(len(data)) * 8
+	first := mix64(hashKey(item))
+	second := mix64(first) | 1
+
+	var missing []uint64
+	for i := range uint64(filter[0]) {
+		position := (first + i*second) % size
+		if data[position/8]&(1<<(position%8)) == 0 {
+			missing = append(missing, position)
+		}
+	}
+	return missing
+}
+
+// BloomReserve creates an empty filter under key sized for capacity items at errorRate false positives.
+func (cache *cache) BloomReserve(key string, errorRate float64, capacity uint64) error {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	if _, exists := shard.lookup(key, now); exists {
+		return errBloomExists
+	}
+
+	bytes, hashes := bloomSize(errorRate, capacity)
+	err := cache.checkDataSize(key, 1+bytes)
+	if err != nil {
+		return err
+	}
+	return shard.put(key, newBloomNode(bytes, hashes, expiryFrom(now, cache.defaultTimeToLive())))
+}
+
+// BloomAdd adds item to the filter stored under key, creating a default sized one if needed.
+// Returns false if the item may have been added already.
+func (cache *cache) BloomAdd(key, item string) (bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, bloomKind, now)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		bytes, hashes := bloomSize(defaultBloomErrorRate, defaultBloomCapacity)
+		err = cache.checkDataSize(key, 1+bytes)
+		if err != nil {
+			return false, err
+		}
+		node = newBloomNode(bytes, hashes, expiryFrom(now, cache.defaultTimeToLive()))
+	}
+
+	missing := bloomMissing(node.Bits, item)
+	if len(missing) == 0 {
+		return false, nil
+	}
+	err = shard.makeRoom(key, node.byteSize(key))
+	if err != nil {
+		return false, err
+	}
+
+	for _, position := range missing {
+		node.Bits[1+position/8] |= 1 << (position % 8)
+	}
+	shard.commit(key, node)
+	return true, nil
+}
+
+// BloomExists reports whether item may have been added to the filter stored under key.
+func (cache *cache) BloomExists(key, item string) (bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, bloomKind, time.Now())
+	if !ok || err != nil {
+		return false, err
+	}
+
+	shard.policy.access(key)
+	return len(bloomMissing(node.Bits, item)) == 0, nil
+}
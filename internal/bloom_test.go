@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.NodeSize = 4096
+	})
+	if err := cache.BloomReserve("seen", 0.01, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.BloomReserve("seen", 0.01, 1000); !errors.Is(err, errBloomExists) {
+		t.Errorf("reserving an existing filter: got %v", err)
+	}
+
+	for i := range 1000 {
+		added, err := cache.BloomAdd("seen", fmt.Sprintf("item:%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added && i == 0 {
+			t.Error("the first item was reported as seen")
+		}
+	}
+	if added, _ := cache.BloomAdd("seen", "item:0"); added {
+		t.Error("an added item was added again")
+	}
+
+	falsePositives := 0
+	for i := range 10000 {
+		if ok, _ := cache.BloomExists("seen", fmt.Sprintf("item:%d", i)); !ok && i < 1000 {
+			t.Fatalf("item:%d was added but isn't found", i)
+		} else if ok && i >= 1000 {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 9000; rate > 0.02 {
+		t.Errorf("false positive rate of %.3f for 0.01", rate)
+	}
+}
+
+func TestBloomFilterLimits(t *testing.T) {
+	cache := newTestCache(nil)
+	if err := cache.BloomReserve("large", 0.001, 100000); err == nil {
+		t.Error("a filter larger than the node size was reserved")
+	}
+
+	cache.Set("text", []byte("value"), 0)
+	if _, err := cache.BloomAdd("text", "item"); !errors.Is(err, errWrongType) {
+		t.Errorf("adding to a string: got %v", err)
+	}
+	if ok, err := cache.BloomExists("missing", "item"); ok || err != nil {
+		t.Errorf("checking a missing filter: got %t, %v", ok, err)
+	}
+}
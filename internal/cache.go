@@ -1,78 +1,670 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// Shard count used when the pool configuration leaves it unset
+	defaultShardCount = 16
+	// Shards are halved until each one holds at least this many nodes
+	minNodesPerShard = 16
+	// Removal versions kept per shard, keys sharing a slot share their version
+	removalSlots = 256
+	// SCAN cursors have room for 8 bits of shard index
+	maxShardCount = 256
+)
+
+// cache splits the key space into independently locked shards so that
+// connections working on different keys never wait on each other.
 type cache struct {
-	Data            map[string]cacheNode `json:"data"`
-	Capacity        uint32               `json:"capacity"`
-	CumulativeBytes uint32               `json:"cumulativeBytes"`
-	NodeTimeToLive  uint16               `json:"nodeTimeToLive"`
-	NodeSize        uint16               `json:"nodeSize"`
-	LimitInBytes    uint32               `json:"limitInBytes"`
-	Mutex           sync.RWMutex         `json:"-"`
+	shards []*cacheShard
+	// The shard count is a power of two, a key hash masked with it picks the shard
+	shardMask      uint64
+	Capacity       uint32
+	NodeTimeToLive uint16
+	NodeSize       uint16
+	LimitInBytes   uint32
+	EvictionPolicy string
+	stats          *cacheStats
+	// Last version handed out to a written node
+	version atomic.Uint64
+	// Shard the next active expiry cycle starts from, only used by the sweeper
+	expiryShard int
+	// Keyspace events published to pubsub, none when notifications are disabled
+	events keyspaceEvent
+	pubsub *pubsub
+	locks  *lockTable
+}
+
+// cacheShard owns a slice of the key space behind its own lock.
+// The node and byte limits are enforced per shard, each getting an equal share of the cache limits.
+type cacheShard struct {
+	Data            map[string]cacheNode
+	Capacity        uint32
+	CumulativeBytes uint32
+	LimitInBytes    uint32
+	Mutex           sync.RWMutex
+	// Held for reading by every request keyed to the shard and for writing on
+	// every shard by EXEC and scripts, see enterGate
+	gate sync.RWMutex
+	// Keys holding an expiry, sampled by the expiry sweeper
+	volatile map[string]struct{}
+	// Connections blocked on a list key, woken when it is pushed to
+	waiters map[string][]chan struct{}
+	// Version of the last removal of a key in each removal slot, what a missing
+	// key reads as to WATCH so it notices the key being created then removed
+	removals [removalSlots]uint64
+	// Every key in scan order, so SCAN resumes without sorting the shard
+	scanIndex *scanIndex
+	policy    evictionPolicy
+	cache     *cache
+}
+
+// evictionPolicy picks the key to evict when the node or byte limit is reached.
+// Implementations are guarded by the shard lock.
+type evictionPolicy interface {
+	// add is called every time a node is written under key
+	add(key string, node cacheNode)
+	// access is called every time key is read
+	access(key string)
+	remove(key string)
+	// victim returns the next key to evict, false if none can be evicted
+	victim() (string, bool)
+	// evictable reports whether key can be picked as a victim
+	evictable(key string) bool
 }
 
+// nodeKind is the type of value a node holds
+type nodeKind string
+
+const (
+	// Plain string nodes leave the kind empty, which keeps older backups valid
+	stringKind nodeKind = ""
+	hashKind   nodeKind = "hash"
+	listKind   nodeKind = "list"
+	setKind    nodeKind = "set"
+	zsetKind   nodeKind = "zset"
+	bloomKind  nodeKind = "bloom"
+	hllKind    nodeKind = "hll"
+	// Rate limiter state, held in Hash but not a hash to the hash commands
+	rateLimitKind nodeKind = "ratelimit"
+)
+
+var errWrongType = errors.New("WRONGTYPE operation against a key holding the wrong kind of value")
+
 type cacheNode struct {
-	Value  string    `json:"value"`
+	Kind  nodeKind            `json:"kind,omitempty"`
+	Value []byte              `json:"bytes,omitempty"`
+	Hash  map[string]string   `json:"hash,omitempty"`
+	List  *deque              `json:"list,omitempty"`
+	Set   map[string]struct{} `json:"set,omitempty"`
+	ZSet  *sortedSet          `json:"zset,omitempty"`
+	// Binary content of Bloom filter and HyperLogLog nodes
+	Bits []byte `json:"bits,omitempty"`
+	// A zero expiry means the node never expires
 	Expiry time.Time `json:"expiry"`
+	// Changes on every write, unique across the cache so a deleted and
+	// recreated key never repeats a version
+	Version uint64 `json:"version"`
+	// Sum of the element lengths of a collection node, kept up to date by every
+	// collection command so its size doesn't need to be recounted
+	elementBytes uint32
+	// Bytes accounted to the node when it was last stored
+	size uint32
 }
 
-func (cache *cache) Set(key, value string) error {
-	now := time.Now()
-	cacheNode := cacheNode{
-		Value:  value,
-		Expiry: now.Add(300 * time.Second),
+const (
+	// Approximate bookkeeping cost of a node on top of its key and value:
+	// the map entry, the expiry, scan and eviction policy indexes
+	nodeOverheadBytes = 64
+	// Approximate cost of every element of a collection node on top of its content
+	elementOverheadBytes = 16
+	// Content size of a sorted set score
+	scoreBytes = 8
+)
+
+// dataSize is the length of the content of the node, checked against the node size limit
+func (node cacheNode) dataSize() int {
+	switch node.Kind {
+	case stringKind:
+		return len(node.Value)
+	case bloomKind, hllKind:
+		return len(node.Bits)
+	default:
+		return int(node.elementBytes)
+	}
+}
+
+func (node cacheNode) elements() int {
+	switch node.Kind {
+	case hashKind, rateLimitKind:
+		return len(node.Hash)
+	case listKind:
+		return node.List.length()
+	case setKind:
+		return len(node.Set)
+	case zsetKind:
+		return node.ZSet.length()
+	default:
+		return 0
+	}
+}
+
+// byteSize is the amount of memory accounted to the node stored under key
+func (node cacheNode) byteSize(key string) uint32 {
+	return nodeByteSize(key, node.dataSize(), node.elements())
+}
+
+// nodeByteSize is the memory accounted to a node under key holding dataSize
+// bytes of content split in the given number of elements
+func nodeByteSize(key string, dataSize, elements int) uint32 {
+	return uint32(nodeOverheadBytes + len(key) + dataSize + elements*elementOverheadBytes)
+}
+
+// recount recomputes elementBytes from the content of a collection node
+func (node *cacheNode) recount() {
+	node.elementBytes = 0
+	for field, value := range node.Hash {
+		node.elementBytes += uint32(len(field) + len(value))
+	}
+	if node.List != nil {
+		for i := range node.List.length() {
+			node.elementBytes += uint32(len(node.List.at(i)))
+		}
+	}
+	for member := range node.Set {
+		node.elementBytes += uint32(len(member))
 	}
+	if node.ZSet != nil {
+		for member := range node.ZSet.scores {
+			node.elementBytes += uint32(len(member) + scoreBytes)
+		}
+	}
+}
 
-	incomingDataByteSize := len(key) + len(value)
+// clone copies the node so its collection can be read outside of the shard lock
+func (node cacheNode) clone() cacheNode {
+	if node.Hash != nil {
+		hash := make(map[string]string, len(node.Hash))
+		for field, value := range node.Hash {
+			hash[field] = value
+		}
+		node.Hash = hash
+	}
+	if node.List != nil {
+		node.List = node.List.clone()
+	}
+	if node.Set != nil {
+		node.Set = maps.Clone(node.Set)
+	}
+	if node.ZSet != nil {
+		node.ZSet = node.ZSet.clone()
+	}
+	if node.Bits != nil {
+		node.Bits = slices.Clone(node.Bits)
+	}
+	return node
+}
+
+func (node cacheNode) expired(now time.Time) bool {
+	return !node.Expiry.IsZero() && !node.Expiry.After(now)
+}
 
-	if incomingDataByteSize > int(cache.NodeSize) {
+// shardCount picks the number of shards for config, a power of two no larger
+// than requested that still leaves every shard room for a few nodes.
+func shardCount(config *poolConfig) int {
+	requested := int(config.Shards)
+	if requested == 0 {
+		requested = defaultShardCount
+	}
+	if requested > maxShardCount {
+		requested = maxShardCount
+	}
+
+	count := 1
+	for count*2 <= requested {
+		count *= 2
+	}
+
+	// a HyperLogLog holds a key within the node size next to its registers
+	largestNode := uint32(config.NodeSize) + hllMaxBytes + nodeOverheadBytes
+	for count > 1 &&
+		(config.NodeLimit/uint32(count) < minNodesPerShard ||
+			config.CacheLimit/uint32(count) < minNodesPerShard*largestNode) {
+		count /= 2
+	}
+	return count
+}
+
+// newCache builds an empty cache for config, keyspace events are published to pubsub.
+func newCache(config *poolConfig, pubsub *pubsub) *cache {
+	count := shardCount(config)
+	events, _ := parseKeyspaceEvents(config.KeyspaceEvents)
+	cache := &cache{
+		shards:         make([]*cacheShard, count),
+		shardMask:      uint64(count - 1),
+		Capacity:       config.NodeLimit,
+		NodeTimeToLive: config.TimeToLive,
+		NodeSize:       config.NodeSize,
+		LimitInBytes:   config.CacheLimit,
+		EvictionPolicy: config.EvictionPolicy,
+		stats:          &cacheStats{},
+		events:         events,
+		pubsub:         pubsub,
+		locks:          newLockTable(),
+	}
+
+	for i := range cache.shards {
+		policy, err := newEvictionPolicy(config.EvictionPolicy)
+		if err != nil {
+			policy = newLRUPolicy()
+		}
+
+		cache.shards[i] = &cacheShard{
+			Data:         make(map[string]cacheNode),
+			Capacity:     (config.NodeLimit + uint32(count) - 1) / uint32(count),
+			LimitInBytes: (config.CacheLimit + uint32(count) - 1) / uint32(count),
+			volatile:     make(map[string]struct{}),
+			waiters:      make(map[string][]chan struct{}),
+			scanIndex:    newScanIndex(),
+			policy:       policy,
+			cache:        cache,
+		}
+	}
+	return cache
+}
+
+func (cache *cache) shardFor(key string) *cacheShard {
+	return cache.shards[hashKey(key)&cache.shardMask]
+}
+
+// lockShards write locks every shard holding one of keys. Shards are always
+// locked in index order so concurrent multi key operations can't deadlock.
+func (cache *cache) lockShards(keys []string) []*cacheShard {
+	indexes := make([]bool, len(cache.shards))
+	for _, key := range keys {
+		indexes[hashKey(key)&cache.shardMask] = true
+	}
+
+	shards := make([]*cacheShard, 0, len(keys))
+	for i, locked := range indexes {
+		if locked {
+			cache.shards[i].Mutex.Lock()
+			shards = append(shards, cache.shards[i])
+		}
+	}
+	return shards
+}
+
+func unlockShards(shards []*cacheShard) {
+	for _, shard := range shards {
+		shard.Mutex.Unlock()
+	}
+}
+
+// defaultTimeToLive is the lifetime given to nodes written without an explicit one.
+// A configured time to live of zero disables expiry by default.
+func (cache *cache) defaultTimeToLive() time.Duration {
+	return time.Duration(cache.NodeTimeToLive) * time.Second
+}
+
+func (cache *cache) nextVersion() uint64 {
+	return cache.version.Add(1)
+}
+
+// enterGate read locks the transaction gate of the shard of key and returns it.
+// Transactions write lock every gate, so they never interleave with a request,
+// while requests only share a gate with the ones keyed to the same shard.
+func (cache *cache) enterGate(key string) *sync.RWMutex {
+	gate := &cache.shardFor(key).gate
+	gate.RLock()
+	return gate
+}
+
+// lockGates write locks the transaction gate of every shard, in shard order
+func (cache *cache) lockGates() {
+	for _, shard := range cache.shards {
+		shard.gate.Lock()
+	}
+}
+
+func (cache *cache) unlockGates() {
+	for _, shard := range cache.shards {
+		shard.gate.Unlock()
+	}
+}
+
+func removalSlot(key string) int {
+	// the low bits of the hash select the shard, the top ones the slot
+	return int((hashKey(key) >> 56) % removalSlots)
+}
+
+// checkNodeSize rejects values that would make a node exceed the node size limit
+func (cache *cache) checkNodeSize(key string, value []byte) error {
+	return cache.checkDataSize(key, len(value))
+}
+
+// checkDataSize rejects node content of size bytes that would exceed the node size limit
+func (cache *cache) checkDataSize(key string, size int) error {
+	if len(key)+size > int(cache.NodeSize) {
 		return fmt.Errorf("node byte limit exceeded. Max is: %d", cache.NodeSize)
 	}
+	return nil
+}
 
-	if incomingDataByteSize+int(cache.CumulativeBytes) > int(cache.LimitInBytes) {
-		return fmt.Errorf("cache byte limit exceeded. Max is: %d", cache.LimitInBytes)
+func expiryFrom(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// restore loads nodes from a backup, expired ones are dropped.
+// The version counter resumes from version or the newest node, whichever is higher.
+func (cache *cache) restore(data map[string]cacheNode, version uint64) {
+	cache.version.Store(version)
+
+	now := time.Now()
+	for key, node := range data {
+		if node.expired(now) {
+			continue
+		}
+
+		node.recount()
+		node.size = node.byteSize(key)
+
+		shard := cache.shardFor(key)
+		shard.Mutex.Lock()
+		shard.store(key, node)
+		shard.CumulativeBytes += node.size
+		shard.Mutex.Unlock()
+
+		if node.Version > cache.version.Load() {
+			cache.version.Store(node.Version)
+		}
+	}
+}
+
+// snapshot copies every node, one shard at a time.
+func (cache *cache) snapshot() map[string]cacheNode {
+	data := make(map[string]cacheNode)
+	for _, shard := range cache.shards {
+		shard.Mutex.RLock()
+		for key, node := range shard.Data {
+			data[key] = node.clone()
+		}
+		shard.Mutex.RUnlock()
+	}
+	return data
+}
+
+// store writes node under key and keeps the expiry and eviction indexes in sync.
+// Byte accounting is left to the caller.
+// Must be called with the write lock held.
+func (shard *cacheShard) store(key string, node cacheNode) {
+	if _, ok := shard.Data[key]; !ok {
+		shard.scanIndex.insert(key)
+	}
+	shard.Data[key] = node
+	shard.policy.add(key, node)
+	if node.Expiry.IsZero() {
+		delete(shard.volatile, key)
 	} else {
-		cache.CumulativeBytes = uint32(incomingDataByteSize) + cache.CumulativeBytes
+		shard.volatile[key] = struct{}{}
+	}
+}
+
+// forget drops key from the data and every index.
+// Must be called with the write lock held.
+func (shard *cacheShard) forget(key string) {
+	if _, ok := shard.Data[key]; ok {
+		shard.scanIndex.remove(key)
+		shard.removals[removalSlot(key)] = shard.cache.nextVersion()
+	}
+	delete(shard.Data, key)
+	delete(shard.volatile, key)
+	shard.policy.remove(key)
+}
+
+// remove deletes key on behalf of a verb and releases its bytes.
+// Must be called with the write lock held.
+func (shard *cacheShard) remove(key string) {
+	if shard.discard(key) {
+		shard.cache.notify(eventDel, key)
+	}
+}
+
+// discard deletes key and releases its bytes without notifying anyone.
+// Returns false if the key wasn't stored.
+// Must be called with the write lock held.
+func (shard *cacheShard) discard(key string) bool {
+	node, ok := shard.Data[key]
+	if !ok {
+		return false
+	}
+
+	shard.releaseBytes(node.size)
+	shard.forget(key)
+	return true
+}
+
+func (shard *cacheShard) releaseBytes(size uint32) {
+	if size > shard.CumulativeBytes {
+		size = shard.CumulativeBytes
+	}
+	shard.CumulativeBytes -= size
+}
+
+// usedBytesWithout is the accounted memory excluding the node stored under key.
+// Must be called with the lock held.
+func (shard *cacheShard) usedBytesWithout(key string) uint32 {
+	node, ok := shard.Data[key]
+	if !ok {
+		return shard.CumulativeBytes
+	}
+	return shard.CumulativeBytes - node.size
+}
+
+// evict removes the key chosen by the eviction policy.
+// Returns false if there is nothing left to evict.
+// Must be called with the write lock held.
+func (shard *cacheShard) evict() bool {
+	key, ok := shard.policy.victim()
+	if !ok {
+		return false
+	}
+
+	shard.cache.stats.evictedKeys.Add(1)
+	shard.cache.stats.evictedBytes.Add(uint64(shard.Data[key].size))
+	shard.discard(key)
+	shard.cache.notify(eventEvicted, key)
+	return true
+}
+
+// lookup returns the live node stored under key, expiring it if it is due.
+// Must be called with the write lock held.
+func (shard *cacheShard) lookup(key string, now time.Time) (cacheNode, bool) {
+	node, ok := shard.Data[key]
+	if !ok {
+		return cacheNode{}, false
 	}
 
-	cache.Mutex.Lock()
-	defer cache.Mutex.Unlock()
+	if node.expired(now) {
+		shard.expireNode(key)
+		return cacheNode{}, false
+	}
+	return node, true
+}
 
-	delete(cache.Data, key)
-	cache.Data[key] = cacheNode
+// lookupKind is lookup for commands that only work on nodes of kind.
+// Must be called with the write lock held.
+func (shard *cacheShard) lookupKind(key string, kind nodeKind, now time.Time) (cacheNode, bool, error) {
+	node, ok := shard.lookup(key, now)
+	if ok && node.Kind != kind {
+		return node, true, errWrongType
+	}
+	return node, ok, nil
+}
 
-	if len(cache.Data) > int(cache.Capacity) {
-		// delete first key
-		for keyToBeDeleted := range cache.Data {
-			delete(cache.Data, keyToBeDeleted)
-			break
+// makeRoom evicts keys until a node of size bytes fits under key.
+// The node under key may be evicted too, the caller stores it right after.
+// Must be called with the write lock held.
+func (shard *cacheShard) makeRoom(key string, size uint32) error {
+	if _, ok := shard.Data[key]; !ok {
+		for len(shard.Data) >= int(shard.Capacity) {
+			if !shard.evict() {
+				return fmt.Errorf("cache node limit exceeded. Max is: %d", shard.cache.Capacity)
+			}
+		}
+	}
+
+	for uint64(shard.usedBytesWithout(key))+uint64(size) > uint64(shard.LimitInBytes) {
+		if !shard.evict() {
+			return fmt.Errorf("cache byte limit exceeded. Max is: %d", shard.cache.LimitInBytes)
 		}
 	}
 	return nil
 }
 
-func (cache *cache) Get(key string) (string, bool) {
-	cache.Mutex.RLock()
-	defer cache.Mutex.RUnlock()
+// commit stores node under key with a new version and accounts its bytes.
+// Room must have been made for it beforehand.
+// Must be called with the write lock held.
+func (shard *cacheShard) commit(key string, node cacheNode) {
+	node.size = node.byteSize(key)
+	node.Version = shard.cache.nextVersion()
+	shard.CumulativeBytes = shard.usedBytesWithout(key) + node.size
+	shard.store(key, node)
+	shard.cache.notify(eventSet, key)
+}
 
-	node, ok := cache.Data[key]
+// put stores node under key with a new version, evicting other keys if the shard limits are reached.
+// Must be called with the write lock held.
+func (shard *cacheShard) put(key string, node cacheNode) error {
+	err := shard.makeRoom(key, node.byteSize(key))
+	if err != nil {
+		return err
+	}
 
-	if node.Expiry.Before(time.Now()) {
-		delete(cache.Data, key)
-		return "", true
+	shard.commit(key, node)
+	return nil
+}
+
+// Set stores value under key. A ttl of zero applies the cache default time to live.
+func (cache *cache) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := cache.SetIf(key, value, setOptions{ttl: ttl})
+	return err
+}
+
+func (cache *cache) Get(key string) ([]byte, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, stringKind, time.Now())
+	if !ok || err != nil {
+		return nil, false, err
 	}
 
-	return node.Value, ok
+	shard.policy.access(key)
+	return node.Value, true, nil
 }
 
 func (cache *cache) Delete(key string) {
-	cache.Mutex.Lock()
-	defer cache.Mutex.Unlock()
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	shard.remove(key)
+}
+
+// Info reports the cache usage and expiry counters as name:value pairs
+func (cache *cache) Info() []string {
+	keys, bytes := 0, uint64(0)
+	for _, shard := range cache.shards {
+		shard.Mutex.RLock()
+		keys += len(shard.Data)
+		bytes += uint64(shard.CumulativeBytes)
+		shard.Mutex.RUnlock()
+	}
+
+	return []string{
+		fmt.Sprintf("keys:%d", keys),
+		fmt.Sprintf("bytes:%d", bytes),
+		fmt.Sprintf("shards:%d", len(cache.shards)),
+		fmt.Sprintf("locks:%d", cache.locks.count()),
+		fmt.Sprintf("expired_keys:%d", cache.stats.expiredKeys.Load()),
+		fmt.Sprintf("expired_bytes:%d", cache.stats.expiredBytes.Load()),
+		fmt.Sprintf("expiry_cycles:%d", cache.stats.expiryCycles.Load()),
+		fmt.Sprintf("evicted_keys:%d", cache.stats.evictedKeys.Load()),
+		fmt.Sprintf("evicted_bytes:%d", cache.stats.evictedBytes.Load()),
+	}
+}
+
+// Expire sets a new time to live on an existing key, a non positive ttl deletes it.
+// Returns false if the key does not exist.
+func (cache *cache) Expire(key string, ttl time.Duration) bool {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, ok := shard.lookup(key, now)
+	if !ok {
+		return false
+	}
+
+	if ttl <= 0 {
+		shard.remove(key)
+		return true
+	}
+
+	node.Expiry = now.Add(ttl)
+	node.Version = cache.nextVersion()
+	shard.store(key, node)
+	return true
+}
+
+// TimeToLive returns the remaining lifetime of key, or -1 if the key never expires.
+// Returns false if the key does not exist.
+func (cache *cache) TimeToLive(key string) (time.Duration, bool) {
+	shard := cache.shardFor(key)
+	shard.Mutex.RLock()
+	defer shard.Mutex.RUnlock()
+
+	now := time.Now()
+	node, ok := shard.Data[key]
+	if !ok || node.expired(now) {
+		return 0, false
+	}
+
+	if node.Expiry.IsZero() {
+		return -1, true
+	}
+
+	return node.Expiry.Sub(now), true
+}
+
+// Persist removes the expiry of key.
+// Returns false if the key does not exist.
+func (cache *cache) Persist(key string) bool {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok := shard.lookup(key, time.Now())
+	if !ok {
+		return false
+	}
 
-	delete(cache.Data, key)
+	node.Expiry = time.Time{}
+	node.Version = cache.nextVersion()
+	shard.store(key, node)
+	return true
 }
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+// Run with different GOMAXPROCS values to see throughput scale with the shard count:
+//
+//	go test ./internal -run '^$' -bench 'Cache|Dispatch' -cpu 1,2,4,8
+
+const benchmarkKeys = 4096
+
+func benchmarkCache(shards uint16) *cache {
+	config := DefaultServerConfig().PoolConfig
+	config.NodeLimit = benchmarkKeys * 2
+	config.CacheLimit = benchmarkKeys * 2 * 1024
+	config.TimeToLive = 0
+	config.Shards = shards
+
+	cache := newCache(config, newPubsub())
+	for i := 0; i < benchmarkKeys; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), []byte("value"), 0)
+	}
+	return cache
+}
+
+// newTestCache is a cache with the default configuration, changed by configure if given
+func newTestCache(configure func(config *poolConfig)) *cache {
+	config := DefaultServerConfig().PoolConfig
+	if configure != nil {
+		configure(config)
+	}
+	return newCache(config, newPubsub())
+}
+
+func benchmarkKeyNames() []string {
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	return keys
+}
+
+// runCacheBenchmark runs operation in parallel over random keys, once per shard count
+func runCacheBenchmark(b *testing.B, operation func(cache *cache, key string, i int)) {
+	for _, shards := range []uint16{1, defaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := benchmarkCache(shards)
+			keys := benchmarkKeyNames()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				random := rand.New(rand.NewSource(rand.Int63()))
+				i := 0
+				for pb.Next() {
+					operation(cache, keys[random.Intn(len(keys))], i)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	runCacheBenchmark(b, func(cache *cache, key string, i int) {
+		cache.Get(key)
+	})
+}
+
+func BenchmarkCacheSet(b *testing.B) {
+	runCacheBenchmark(b, func(cache *cache, key string, i int) {
+		cache.Set(key, []byte("value"), 0)
+	})
+}
+
+// BenchmarkCacheMixed issues one write for every nine reads
+func BenchmarkCacheMixed(b *testing.B) {
+	runCacheBenchmark(b, func(cache *cache, key string, i int) {
+		if i%10 == 0 {
+			cache.Set(key, []byte("value"), 0)
+		} else {
+			cache.Get(key)
+		}
+	})
+}
+
+// BenchmarkDispatchMixed is BenchmarkCacheMixed through the request dispatch,
+// including the transaction gate every request holds and its logging
+func BenchmarkDispatchMixed(b *testing.B) {
+	output := color.Output
+	color.Output = io.Discard
+	defer func() { color.Output = output }()
+
+	for _, shards := range []uint16{1, defaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			lebreServer := &LebreServer{cache: benchmarkCache(shards)}
+			keys := benchmarkKeyNames()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				session := &session{logger: NewCli(), authorized: true}
+				random := rand.New(rand.NewSource(rand.Int63()))
+				for i := 0; pb.Next(); i++ {
+					key := keys[random.Intn(len(keys))]
+					if i%10 == 0 {
+						lebreServer.dispatch(session, []string{protocolV2, "SET", key, "value"})
+					} else {
+						lebreServer.dispatch(session, []string{protocolV2, "GET", key})
+					}
+				}
+			})
+		})
+	}
+}
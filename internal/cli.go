@@ -122,10 +122,20 @@ func (cli *Cli) Help(command string) {
 		fmt.Println("│ which will override the default configuration from the server setup")
 		fmt.Println()
 
+	case "fingerprint":
+		fmt.Print("\n│ ")
+		cli.Info.Print(command)
+		cli.Warning.Print(" --config")
+		fmt.Println(" [configuration file path (*.lebre)]")
+		fmt.Println("│ This command prints the fingerprint of the server identity key,")
+		fmt.Println("│ which clients pin to make sure they are talking to this server")
+		fmt.Println()
+
 	default:
 		commandsTable := [][3]string{
 			{"init", "", "Creates a new server"},
 			{"start", "", "Starts the server"},
+			{"fingerprint", "", "Shows the server identity fingerprint"},
 			// {"status", "", "Returns the status of the server"},
 			// {"config (get|set)", "", "Server configuration"},
 			{"help", "[command]", "Shows this menu"},
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"time"
+)
+
+type setOptions struct {
+	// Zero applies the cache default time to live
+	ttl time.Duration
+	// Only write if the key does not exist yet (NX)
+	onlyIfMissing bool
+	// Only write if the key already exists (XX)
+	onlyIfExists bool
+}
+
+// SetIf stores value under key when the conditions in options hold.
+// Returns false if the write was skipped because of them.
+func (cache *cache) SetIf(key string, value []byte, options setOptions) (bool, error) {
+	ttl := options.ttl
+	if ttl == 0 {
+		ttl = cache.defaultTimeToLive()
+	}
+
+	err := cache.checkNodeSize(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	_, exists := shard.lookup(key, now)
+	if (options.onlyIfMissing && exists) || (options.onlyIfExists && !exists) {
+		return false, nil
+	}
+
+	err = shard.put(key, cacheNode{Value: value, Expiry: expiryFrom(now, ttl)})
+	return err == nil, err
+}
+
+// GetSet stores value under key with the default time to live and returns the previous value.
+func (cache *cache) GetSet(key string, value []byte) ([]byte, bool, error) {
+	err := cache.checkNodeSize(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	previous, exists, err := shard.lookupKind(key, stringKind, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = shard.put(key, cacheNode{Value: value, Expiry: expiryFrom(now, cache.defaultTimeToLive())})
+	if err != nil {
+		return nil, false, err
+	}
+	return previous.Value, exists, nil
+}
+
+// GetDelete removes key and returns the value it held.
+func (cache *cache) GetDelete(key string) ([]byte, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, stringKind, time.Now())
+	if !ok || err != nil {
+		return nil, false, err
+	}
+
+	shard.remove(key)
+	return node.Value, true, nil
+}
+
+// GetWithVersion returns the value stored under key along with its version,
+// to be handed back to CompareAndSwap.
+func (cache *cache) GetWithVersion(key string) ([]byte, uint64, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, stringKind, time.Now())
+	if !ok || err != nil {
+		return nil, 0, false, err
+	}
+
+	shard.policy.access(key)
+	return node.Value, node.Version, true, nil
+}
+
+type casResult int
+
+const (
+	casStored casResult = iota
+	// The key changed since the version was read
+	casConflict
+	casNotFound
+)
+
+// CompareAndSwap stores value under key only if the key still holds version.
+// A ttl of zero applies the cache default time to live.
+func (cache *cache) CompareAndSwap(key string, version uint64, value []byte, ttl time.Duration) (casResult, error) {
+	if ttl == 0 {
+		ttl = cache.defaultTimeToLive()
+	}
+
+	err := cache.checkNodeSize(key, value)
+	if err != nil {
+		return casConflict, err
+	}
+
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, ok, err := shard.lookupKind(key, stringKind, now)
+	if err != nil {
+		return casConflict, err
+	}
+	if !ok {
+		return casNotFound, nil
+	}
+	if node.Version != version {
+		return casConflict, nil
+	}
+
+	err = shard.put(key, cacheNode{Value: value, Expiry: expiryFrom(now, ttl)})
+	if err != nil {
+		return casConflict, err
+	}
+	return casStored, nil
+}
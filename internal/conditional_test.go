@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetIf(t *testing.T) {
+	tests := []struct {
+		name     string
+		exists   bool
+		options  setOptions
+		expected bool
+	}{
+		{"plain write to a missing key", false, setOptions{}, true},
+		{"plain write to an existing key", true, setOptions{}, true},
+		{"NX on a missing key", false, setOptions{onlyIfMissing: true}, true},
+		{"NX on an existing key", true, setOptions{onlyIfMissing: true}, false},
+		{"XX on a missing key", false, setOptions{onlyIfExists: true}, false},
+		{"XX on an existing key", true, setOptions{onlyIfExists: true}, true},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(nil)
+		if test.exists {
+			cache.Set("key", []byte("old"), 0)
+		}
+
+		stored, err := cache.SetIf("key", []byte("new"), test.options)
+		if err != nil || stored != test.expected {
+			t.Errorf("%s: got %t, %v", test.name, stored, err)
+		}
+		value, _, _ := cache.Get("key")
+		if written := string(value) == "new"; written != test.expected {
+			t.Errorf("%s: the key holds %q", test.name, value)
+		}
+	}
+
+	cache := newTestCache(nil)
+	cache.Set("key", []byte("old"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if stored, _ := cache.SetIf("key", []byte("new"), setOptions{onlyIfMissing: true}); !stored {
+		t.Error("NX on an expired key wasn't stored")
+	}
+}
+
+func TestGetSetAndGetDelete(t *testing.T) {
+	cache := newTestCache(nil)
+
+	if _, ok, _ := cache.GetSet("key", []byte("first")); ok {
+		t.Error("GETSET on a missing key returned a previous value")
+	}
+	if previous, ok, _ := cache.GetSet("key", []byte("second")); !ok || string(previous) != "first" {
+		t.Errorf("GETSET returned %q, %t", previous, ok)
+	}
+	if value, ok, _ := cache.GetDelete("key"); !ok || string(value) != "second" {
+		t.Errorf("GETDEL returned %q, %t", value, ok)
+	}
+	if _, ok, _ := cache.GetDelete("key"); ok || cache.Size() != 0 {
+		t.Error("GETDEL didn't remove the key")
+	}
+
+	cache.HashSet("hash", []string{"field"}, []string{"value"})
+	if _, _, err := cache.GetSet("hash", []byte("value")); err == nil {
+		t.Error("GETSET on a hash: expected an error")
+	}
+	if _, _, err := cache.GetDelete("hash"); err == nil || cache.Size() != 1 {
+		t.Errorf("GETDEL on a hash: got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache := newTestCache(nil)
+	if result, _ := cache.CompareAndSwap("key", 1, []byte("value"), 0); result != casNotFound {
+		t.Errorf("CAS on a missing key: got %d", result)
+	}
+
+	cache.Set("key", []byte("first"), 0)
+	_, version, _, _ := cache.GetWithVersion("key")
+
+	tests := []struct {
+		name     string
+		version  uint64
+		value    string
+		expected casResult
+	}{
+		{"stale version", version - 1, "stale", casConflict},
+		{"current version", version, "second", casStored},
+		{"version already swapped", version, "third", casConflict},
+	}
+	for _, test := range tests {
+		if result, err := cache.CompareAndSwap("key", test.version, []byte(test.value), 0); err != nil || result != test.expected {
+			t.Errorf("%s: got %d, %v", test.name, result, err)
+		}
+	}
+
+	value, newVersion, _, _ := cache.GetWithVersion("key")
+	if string(value) != "second" || newVersion <= version {
+		t.Errorf("the key holds %q at version %d after version %d", value, newVersion, version)
+	}
+}
+
+func TestConditionalCommands(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"SET", "key", "first", "XX"}, "NOT_STORED"},
+		{[]string{"SET", "key", "first", "NX", "EX", "60"}, "OK"},
+		{[]string{"SET", "key", "second", "NX"}, "NOT_STORED"},
+		{[]string{"SET", "key", "second", "NX", "XX"}, "ERR NX and XX options at the same time are not compatible"},
+		{[]string{"SET", "key", "second", "EX", "60", "PX", "100"}, "ERR syntax error near 'PX'"},
+		{[]string{"SETNX", "key", "second"}, "NOT_STORED"},
+		{[]string{"SETNX", "other", "value"}, "OK"},
+		{[]string{"GETSET", "key", "second"}, "VALUE first"},
+		{[]string{"GETDEL", "other"}, "VALUE value"},
+		{[]string{"GETDEL", "other"}, "NOT_FOUND"},
+		{[]string{"CAS", "key", "version", "third"}, "ERR invalid version 'version'"},
+		{[]string{"CAS", "missing", "1", "third"}, "NOT_FOUND"},
+	}
+	for _, test := range tests {
+		expectReply(t, strings.Join(test.args, " "), client.do(test.args...), test.expected)
+	}
+
+	var version uint64
+	fmt.Sscanf(client.do("GETS", "key"), "VALUE %d", &version)
+	expectReply(t, "CAS", client.do("CAS", "key", fmt.Sprint(version), "third", "PX", "60000"), "OK")
+	expectReply(t, "CAS", client.do("CAS", "key", fmt.Sprint(version), "fourth"), "EXISTS")
+	expectReply(t, "GET", client.do("GET", "key"), "VALUE third")
+}
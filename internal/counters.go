@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// mutate replaces the value stored under key with the one returned by update,
+// atomically under the shard lock. An existing key keeps its expiry, a missing
+// one is created with the default time to live.
+func (cache *cache) mutate(key string, update func(value string, exists bool) (string, error)) error {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, stringKind, now)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		node.Expiry = expiryFrom(now, cache.defaultTimeToLive())
+	}
+
+	value, err := update(string(node.Value), exists)
+	if err != nil {
+		return err
+	}
+
+	err = cache.checkDataSize(key, len(value))
+	if err != nil {
+		return err
+	}
+
+	node.Value = []byte(value)
+	return shard.put(key, node)
+}
+
+// IncrementBy adds delta to the integer stored under key, a missing key counts as 0.
+func (cache *cache) IncrementBy(key string, delta int64) (int64, error) {
+	var result int64
+	err := cache.mutate(key, func(value string, exists bool) (string, error) {
+		var current int64
+		if exists {
+			var err error
+			current, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("value is not an integer or out of range")
+			}
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) ||
+			(delta < 0 && current < math.MinInt64-delta) {
+			return "", fmt.Errorf("increment or decrement would overflow")
+		}
+
+		result = current + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	return result, err
+}
+
+// IncrementByFloat adds delta to the number stored under key, a missing key counts as 0.
+func (cache *cache) IncrementByFloat(key string, delta float64) (float64, error) {
+	var result float64
+	err := cache.mutate(key, func(value string, exists bool) (string, error) {
+		var current float64
+		if exists {
+			var err error
+			current, err = strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+				return "", fmt.Errorf("value is not a valid float")
+			}
+		}
+
+		result = current + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return "", fmt.Errorf("increment would produce NaN or Infinity")
+		}
+		return strconv.FormatFloat(result, 'f', -1, 64), nil
+	})
+	return result, err
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncrementBy(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		delta    int64
+		expected int64
+		valid    bool
+	}{
+		{"missing key", "", 5, 5, true},
+		{"existing value", "10", -3, 7, true},
+		{"negative result", "1", -2, -1, true},
+		{"largest value", fmt.Sprint(math.MaxInt64 - 1), 1, math.MaxInt64, true},
+		{"overflow", fmt.Sprint(math.MaxInt64), 1, 0, false},
+		{"underflow", fmt.Sprint(math.MinInt64), -1, 0, false},
+		{"text", "ten", 1, 0, false},
+		{"float", "1.5", 1, 0, false},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(nil)
+		if test.initial != "" {
+			cache.Set("counter", []byte(test.initial), 0)
+		}
+
+		result, err := cache.IncrementBy("counter", test.delta)
+		if (err == nil) != test.valid || result != test.expected {
+			t.Errorf("%s: got %d, %v", test.name, result, err)
+		}
+		value, _, _ := cache.Get("counter")
+		if !test.valid && string(value) != test.initial {
+			t.Errorf("%s: a failed increment left %q", test.name, value)
+		}
+	}
+
+	cache := newTestCache(nil)
+	cache.HashSet("hash", []string{"field"}, []string{"1"})
+	if _, err := cache.IncrementBy("hash", 1); err == nil {
+		t.Error("incrementing a hash: expected an error")
+	}
+}
+
+func TestIncrementByFloat(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		delta    float64
+		expected float64
+		valid    bool
+	}{
+		{"missing key", "", 1.5, 1.5, true},
+		{"integer value", "10", 0.25, 10.25, true},
+		{"exponent", "5.0e3", -1000, 4000, true},
+		{"overflow to infinity", fmt.Sprint(math.MaxFloat64), math.MaxFloat64, 0, false},
+		{"stored infinity", "+Inf", 1, 0, false},
+		{"text", "ten", 1, 0, false},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(nil)
+		if test.initial != "" {
+			cache.Set("counter", []byte(test.initial), 0)
+		}
+
+		result, err := cache.IncrementByFloat("counter", test.delta)
+		if (err == nil) != test.valid || (test.valid && result != test.expected) {
+			t.Errorf("%s: got %g, %v", test.name, result, err)
+		}
+	}
+}
+
+func TestCountersAreAtomic(t *testing.T) {
+	cache := newTestCache(nil)
+	var group sync.WaitGroup
+	for range 8 {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for range 1000 {
+				cache.IncrementBy("counter", 1)
+			}
+		}()
+	}
+	group.Wait()
+
+	if value, _, _ := cache.Get("counter"); string(value) != "8000" {
+		t.Errorf("concurrent increments added up to %s", value)
+	}
+}
+
+func TestCountersKeepExpiry(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.TimeToLive = 0
+	})
+	cache.Set("counter", []byte("1"), time.Hour)
+	cache.IncrementBy("counter", 1)
+	if ttl, _ := cache.TimeToLive("counter"); ttl <= 59*time.Minute {
+		t.Errorf("an increment changed the lifetime to %s", ttl)
+	}
+}
+
+func TestCounterCommands(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"INCR", "hits"}, "INTEGER 1"},
+		{[]string{"INCRBY", "hits", "41"}, "INTEGER 42"},
+		{[]string{"DECR", "hits"}, "INTEGER 41"},
+		{[]string{"DECRBY", "hits", "50"}, "INTEGER -9"},
+		{[]string{"DECRBY", "hits", "-9223372036854775808"}, "ERR decrement would overflow"},
+		{[]string{"INCRBY", "hits", "1.5"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCR"}, "ERR wrong number of arguments for INCR"},
+		{[]string{"INCRBYFLOAT", "hits", "0.5"}, "VALUE -8.5"},
+		{[]string{"INCR", "hits"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCRBYFLOAT", "hits", "NaN"}, "ERR value is not a valid float"},
+		{[]string{"GET", "hits"}, "VALUE -8.5"},
+	}
+	for _, test := range tests {
+		expectReply(t, strings.Join(test.args, " "), client.do(test.args...), test.expected)
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import "encoding/json"
+
+const dequeMinCapacity = 8
+
+// deque holds the elements of a list in a ring buffer, giving amortized O(1)
+// pushes and pops at both ends and O(1) access by index.
+type deque struct {
+	items []string
+	head  int
+	count int
+}
+
+func newDeque(values []string) *deque {
+	list := &deque{}
+	for _, value := range values {
+		list.pushBack(value)
+	}
+	return list
+}
+
+func (list *deque) length() int {
+	return list.count
+}
+
+// at returns the element at index, counting from the head
+func (list *deque) at(index int) string {
+	return list.items[(list.head+index)%len(list.items)]
+}
+
+// grow doubles the buffer when it is full, moving the head back to index zero
+func (list *deque) grow() {
+	if list.count < len(list.items) {
+		return
+	}
+	items := make([]string, max(2*len(list.items), dequeMinCapacity))
+	list.copyTo(items, 0, list.count)
+	list.items = items
+	list.head = 0
+}
+
+func (list *deque) pushFront(value string) {
+	list.grow()
+	list.head = (list.head + len(list.items) - 1) % len(list.items)
+	list.items[list.head] = value
+	list.count++
+}
+
+func (list *deque) pushBack(value string) {
+	list.grow()
+	list.items[(list.head+list.count)%len(list.items)] = value
+	list.count++
+}
+
+func (list *deque) popFront() string {
+	value := list.items[list.head]
+	list.items[list.head] = ""
+	list.head = (list.head + 1) % len(list.items)
+	list.count--
+	return value
+}
+
+func (list *deque) popBack() string {
+	last := (list.head + list.count - 1) % len(list.items)
+	value := list.items[last]
+	list.items[last] = ""
+	list.count--
+	return value
+}
+
+// copyTo copies the elements from start to stop exclusive into target, in at most two moves
+func (list *deque) copyTo(target []string, start, stop int) {
+	if start == stop {
+		return
+	}
+	first := (list.head + start) % len(list.items)
+	copied := copy(target, list.items[first:min(len(list.items), first+stop-start)])
+	copy(target[copied:], list.items[:stop-start-copied])
+}
+
+// slice returns a copy of the elements from start to stop exclusive
+func (list *deque) slice(start, stop int) []string {
+	values := make([]string, stop-start)
+	list.copyTo(values, start, stop)
+	return values
+}
+
+func (list *deque) values() []string {
+	return list.slice(0, list.count)
+}
+
+func (list *deque) clone() *deque {
+	return &deque{items: list.values(), count: list.count}
+}
+
+func (list *deque) MarshalJSON() ([]byte, error) {
+	return json.Marshal(list.values())
+}
+
+func (list *deque) UnmarshalJSON(data []byte) error {
+	var values []string
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		return err
+	}
+	*list = *newDeque(values)
+	return nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestDeque(t *testing.T) {
+	list := newDeque(nil)
+	var expected []string
+	// wraps around the ring buffer and grows it with elements on both sides of the head
+	for i := range 100 {
+		value := strconv.Itoa(i)
+		if i%3 == 0 {
+			list.pushBack(value)
+			expected = append(expected, value)
+		} else {
+			list.pushFront(value)
+			expected = slices.Insert(expected, 0, value)
+		}
+		if i%7 == 6 {
+			if list.popBack() != expected[len(expected)-1] || list.popFront() != expected[0] {
+				t.Fatalf("popped the wrong elements after %d pushes", i+1)
+			}
+			expected = expected[1 : len(expected)-1]
+		}
+	}
+
+	if list.length() != len(expected) || !slices.Equal(list.values(), expected) {
+		t.Fatalf("got %q, expected %q", list.values(), expected)
+	}
+	if !slices.Equal(list.slice(10, 20), expected[10:20]) || list.at(5) != expected[5] {
+		t.Error("indexing doesn't count from the head")
+	}
+	if clone := list.clone(); !slices.Equal(clone.values(), expected) {
+		t.Errorf("clone holds %q", clone.values())
+	}
+}
+
+func TestDequeJSON(t *testing.T) {
+	list := newDeque([]string{"b", "c"})
+	list.pushFront("a")
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["a","b","c"]` {
+		t.Errorf("encoded as %s", data)
+	}
+	decoded := newDeque(nil)
+	err = json.Unmarshal(data, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(decoded.values(), list.values()) {
+		t.Errorf("got %q after a round trip through %s", decoded.values(), data)
+	}
+}
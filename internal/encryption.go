@@ -1,67 +1,173 @@
 package internal
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"os"
+	"slices"
 )
 
-func GenerateRSAKeyPair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// Connections agree on a shared secret with an X25519 key exchange, then every
+// frame is sealed with AES-256-GCM under a key per direction derived from it.
+// The server signs the exchange with its persistent Ed25519 identity key so
+// clients can tell it apart from anyone in the middle.
+
+const sessionKeyBytes = 32
+
+// Labels binding each derived key to the direction it encrypts
+var (
+	clientToServerLabel = []byte("lebre client to server")
+	serverToClientLabel = []byte("lebre server to client")
+)
+
+// Prefixes the transcript of the key exchange signed by the identity key
+var handshakeLabel = []byte("lebre handshake")
+
+// GenerateIdentityKey creates a server identity key at path, readable by its owner only.
+// An existing key is never overwritten, it would break every client pinning it.
+func GenerateIdentityKey(path string) error {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
 	}
-	return privateKey, &privateKey.PublicKey, nil
+	defer file.Close()
+
+	return pem.Encode(file, &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyDER,
+	})
 }
 
-func RSAEncrypt(data []byte, publicKey *rsa.PublicKey) ([]byte, error) {
-	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, data)
+func LoadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	pemData, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return ciphertext, nil
-}
 
-func RSADecrypt(ciphertext []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
-	data, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, ciphertext)
+	pemBlock, _ := pem.Decode(pemData)
+	if pemBlock == nil || pemBlock.Type != "PRIVATE KEY" {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
+
+	switch privateKey := privateKey.(type) {
+	case ed25519.PrivateKey:
+		return privateKey, nil
+	default:
+		return nil, fmt.Errorf("not an Ed25519 private key")
+	}
+}
+
+// Fingerprint identifies the public half of an identity key for clients to pin
+func Fingerprint(privateKey ed25519.PrivateKey) string {
+	hash := sha256.Sum256(privateKey.Public().(ed25519.PublicKey))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
 }
 
-func PublicKeyToPEM(publicKey *rsa.PublicKey) ([]byte, error) {
-	publicKeyASN1, err := x509.MarshalPKIXPublicKey(publicKey)
+// handshakeTranscript is what the identity key signs, covering the ephemeral
+// keys of both sides so a signature can't be replayed in another exchange
+func handshakeTranscript(clientKey, serverKey []byte) []byte {
+	return slices.Concat(handshakeLabel, clientKey, serverKey)
+}
+
+func GenerateSessionKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// frameCipher seals or opens the frames sent in one direction of a connection.
+// The nonce of a frame is the number of frames sent before it, so a replayed,
+// dropped or reordered frame fails to open.
+type frameCipher struct {
+	aead     cipher.AEAD
+	sequence uint64
+}
+
+func newFrameCipher(key []byte) (*frameCipher, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	pemBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyASN1,
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
 	}
+	return &frameCipher{aead: aead}, nil
+}
 
-	return pem.EncodeToMemory(pemBlock), nil
+func (frameCipher *frameCipher) nonce() []byte {
+	nonce := make([]byte, frameCipher.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], frameCipher.sequence)
+	frameCipher.sequence++
+	return nonce
 }
 
-func PEMToPublicKey(pemData string) (*rsa.PublicKey, error) {
-	pemBlock, _ := pem.Decode([]byte(pemData))
-	if pemBlock == nil || pemBlock.Type != "PUBLIC KEY" {
-		return nil, errors.New("failed to decode PEM block containing public key")
+func (frameCipher *frameCipher) seal(data []byte) []byte {
+	return frameCipher.aead.Seal(nil, frameCipher.nonce(), data, nil)
+}
+
+func (frameCipher *frameCipher) open(ciphertext []byte) ([]byte, error) {
+	return frameCipher.aead.Open(nil, frameCipher.nonce(), ciphertext, nil)
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) producing a single session key
+func deriveKey(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:sessionKeyBytes]
+}
+
+// sessionCiphers completes the X25519 exchange of privateKey with peerKey and
+// returns the ciphers of the frames sent by the client and by the server.
+// Both public keys salt the derivation, binding the keys to this exchange.
+func sessionCiphers(privateKey *ecdh.PrivateKey, peerKey, clientKey, serverKey []byte) (*frameCipher, *frameCipher, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
+	secret, err := privateKey.ECDH(peer)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	switch publicKey := publicKey.(type) {
-	case *rsa.PublicKey:
-		return publicKey, nil
-	default:
-		return nil, fmt.Errorf("not an RSA public key")
+	salt := append(slices.Clone(clientKey), serverKey...)
+	clientCipher, err := newFrameCipher(deriveKey(secret, salt, clientToServerLabel))
+	if err != nil {
+		return nil, nil, err
+	}
+	serverCipher, err := newFrameCipher(deriveKey(secret, salt, serverToClientLabel))
+	if err != nil {
+		return nil, nil, err
 	}
+	return clientCipher, serverCipher, nil
 }
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// RFC 5869 test case 1, truncated to a session key
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+
+	if key := hex.EncodeToString(deriveKey(secret, salt, info)); key != expected {
+		t.Errorf("got %s, expected %s", key, expected)
+	}
+}
+
+func TestFrameCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, sessionKeyBytes)
+	sender, _ := newFrameCipher(key)
+	receiver, _ := newFrameCipher(key)
+
+	first, second := sender.seal([]byte("first")), sender.seal([]byte("second"))
+	if _, err := receiver.open(second); err == nil {
+		t.Error("a frame received out of order was opened")
+	}
+
+	receiver, _ = newFrameCipher(key)
+	if message, err := receiver.open(first); err != nil || string(message) != "first" {
+		t.Fatalf("got %q, %v", message, err)
+	}
+	if _, err := receiver.open(first); err == nil {
+		t.Error("a replayed frame was opened")
+	}
+}
+
+func TestIdentityKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if err := GenerateIdentityKey(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateIdentityKey(path); !errors.Is(err, os.ErrExist) {
+		t.Errorf("an existing key was overwritten: %v", err)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the key file is %s", info.Mode().Perm())
+	}
+
+	key, err := LoadIdentityKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := Fingerprint(key); len(fingerprint) != len("SHA256:")+43 {
+		t.Errorf("malformed fingerprint %s", fingerprint)
+	}
+}
+
+// encryptedClient runs the client side of the key exchange
+type encryptedClient struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	send    *frameCipher
+	receive *frameCipher
+}
+
+func dialEncrypted(t *testing.T, lebreServer *LebreServer, identity ed25519.PublicKey) *encryptedClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", lebreServer.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	privateKey, _ := GenerateSessionKeyPair()
+	clientKey := privateKey.PublicKey().Bytes()
+	client.write(clientKey)
+
+	reply := []byte(client.read())
+	if len(reply) != 32+ed25519.PublicKeySize+ed25519.SignatureSize {
+		t.Fatalf("server answered %d bytes", len(reply))
+	}
+	serverKey, serverIdentity, signature := reply[:32], reply[32:64], reply[64:]
+	if !bytes.Equal(serverIdentity, identity) {
+		t.Fatal("the server presented another identity key")
+	}
+	if !ed25519.Verify(serverIdentity, handshakeTranscript(clientKey, serverKey), signature) {
+		t.Fatal("the key exchange signature doesn't verify")
+	}
+
+	send, receive, err := sessionCiphers(privateKey, serverKey, clientKey, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &encryptedClient{t: t, conn: conn, reader: client.reader, send: send, receive: receive}
+}
+
+func (client *encryptedClient) testClient() *testClient {
+	return &testClient{t: client.t, conn: client.conn, reader: client.reader}
+}
+
+func (client *encryptedClient) do(args ...string) string {
+	client.t.Helper()
+	client.testClient().write(client.send.seal(v2Request(args...)))
+	reply, err := client.receive.open([]byte(client.testClient().read()))
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func startEncryptedServer(t *testing.T) (*LebreServer, ed25519.PublicKey) {
+	identityKeyFile := filepath.Join(t.TempDir(), "identity.key")
+	if err := GenerateIdentityKey(identityKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	identityKey, _ := LoadIdentityKey(identityKeyFile)
+
+	lebreServer := startTestServer(t, func(serverConfig *ServerConfig) {
+		serverConfig.EnableEncryption = true
+		serverConfig.IdentityKeyFile = identityKeyFile
+	})
+	return lebreServer, identityKey.Public().(ed25519.PublicKey)
+}
+
+func TestEncryptedSession(t *testing.T) {
+	lebreServer, identity := startEncryptedServer(t)
+	client := dialEncrypted(t, lebreServer, identity)
+
+	client.testClient().write(client.send.seal(v2Request("AUTH", testUser, testPassword)))
+	expectReply(t, "SET", client.do("SET", "key", "secret value"), "OK")
+	expectReply(t, "GET", client.do("GET", "key"), "VALUE secret value")
+}
+
+func TestEncryptedSessionRejectsForgedFrames(t *testing.T) {
+	lebreServer, identity := startEncryptedServer(t)
+
+	forgeries := map[string]func(frame []byte) []byte{
+		"tampered": func(frame []byte) []byte {
+			frame[len(frame)-1] ^= 1
+			return frame
+		},
+		"replayed": func(frame []byte) []byte {
+			return frame
+		},
+		"plaintext": func(frame []byte) []byte {
+			return v2Request("GET", "key")
+		},
+	}
+
+	for name, forge := range forgeries {
+		client := dialEncrypted(t, lebreServer, identity)
+		frame := client.send.seal(v2Request("AUTH", testUser, testPassword))
+		client.testClient().write(frame)
+		client.testClient().write(forge(slices.Clone(frame)))
+
+		_, err := client.reader.ReadByte()
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("%s frame: the connection wasn't closed: %v", name, err)
+		}
+	}
+}
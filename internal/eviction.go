@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Number of keys compared when picking an LFU victim
+	lfuSampleSize = 5
+	// Counter given to new keys so they are not evicted right after being written
+	lfuInitialCounter = 5
+	// Higher values make the counter grow slower as it gets larger
+	lfuLogFactor = 10
+	// The counter of a key is halved for every period it goes without being accessed
+	lfuDecayPeriod = time.Minute
+)
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case "", "allkeys-lru":
+		return newLRUPolicy(), nil
+	case "volatile-lru":
+		return newVolatilePolicy(newLRUPolicy()), nil
+	case "allkeys-lfu":
+		return newLFUPolicy(), nil
+	case "volatile-lfu":
+		return newVolatilePolicy(newLFUPolicy()), nil
+	case "allkeys-fifo":
+		return newFIFOPolicy(), nil
+	case "volatile-fifo":
+		return newVolatilePolicy(newFIFOPolicy()), nil
+	case "allkeys-random":
+		return newRandomPolicy(), nil
+	case "volatile-random":
+		return newVolatilePolicy(newRandomPolicy()), nil
+	case "noeviction":
+		return noEvictionPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy '%s'", name)
+	}
+}
+
+// lruPolicy orders keys by recency of use so the least recently used key is evicted first.
+// Every operation is O(1): the list keeps the order and the map locates a key's element.
+type lruPolicy struct {
+	// Front is the most recently used key
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (policy *lruPolicy) add(key string, node cacheNode) {
+	if element, ok := policy.elements[key]; ok {
+		policy.order.MoveToFront(element)
+		return
+	}
+	policy.elements[key] = policy.order.PushFront(key)
+}
+
+func (policy *lruPolicy) access(key string) {
+	if element, ok := policy.elements[key]; ok {
+		policy.order.MoveToFront(element)
+	}
+}
+
+func (policy *lruPolicy) remove(key string) {
+	if element, ok := policy.elements[key]; ok {
+		policy.order.Remove(element)
+		delete(policy.elements, key)
+	}
+}
+
+func (policy *lruPolicy) evictable(key string) bool {
+	_, ok := policy.elements[key]
+	return ok
+}
+
+func (policy *lruPolicy) victim() (string, bool) {
+	element := policy.order.Back()
+	if element == nil {
+		return "", false
+	}
+	return element.Value.(string), true
+}
+
+// fifoPolicy evicts keys in the order they were first written, regardless of use.
+type fifoPolicy struct {
+	// Front is the newest key
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newFIFOPolicy() *fifoPolicy {
+	return &fifoPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (policy *fifoPolicy) add(key string, node cacheNode) {
+	if _, ok := policy.elements[key]; !ok {
+		policy.elements[key] = policy.order.PushFront(key)
+	}
+}
+
+func (policy *fifoPolicy) access(key string) {}
+
+func (policy *fifoPolicy) remove(key string) {
+	if element, ok := policy.elements[key]; ok {
+		policy.order.Remove(element)
+		delete(policy.elements, key)
+	}
+}
+
+func (policy *fifoPolicy) evictable(key string) bool {
+	_, ok := policy.elements[key]
+	return ok
+}
+
+func (policy *fifoPolicy) victim() (string, bool) {
+	element := policy.order.Back()
+	if element == nil {
+		return "", false
+	}
+	return element.Value.(string), true
+}
+
+type lfuEntry struct {
+	// Logarithmic access counter, it saturates at 255
+	counter    uint8
+	lastAccess time.Time
+}
+
+// decayedCounter halves the counter for every lfuDecayPeriod since the last access
+func (entry *lfuEntry) decayedCounter(now time.Time) uint8 {
+	periods := now.Sub(entry.lastAccess) / lfuDecayPeriod
+	if periods >= 8 {
+		return 0
+	}
+	return entry.counter >> uint(periods)
+}
+
+// lfuPolicy evicts the least frequently used key out of a random sample.
+// Counters grow logarithmically and decay over time, so keys that were hot
+// a long time ago eventually become eviction candidates.
+type lfuPolicy struct {
+	entries map[string]*lfuEntry
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (policy *lfuPolicy) add(key string, node cacheNode) {
+	if _, ok := policy.entries[key]; ok {
+		policy.access(key)
+		return
+	}
+	policy.entries[key] = &lfuEntry{counter: lfuInitialCounter, lastAccess: time.Now()}
+}
+
+func (policy *lfuPolicy) access(key string) {
+	entry, ok := policy.entries[key]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	counter := entry.decayedCounter(now)
+	if counter < 255 {
+		base := 0.0
+		if counter > lfuInitialCounter {
+			base = float64(counter - lfuInitialCounter)
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	entry.counter = counter
+	entry.lastAccess = now
+}
+
+func (policy *lfuPolicy) remove(key string) {
+	delete(policy.entries, key)
+}
+
+func (policy *lfuPolicy) evictable(key string) bool {
+	_, ok := policy.entries[key]
+	return ok
+}
+
+func (policy *lfuPolicy) victim() (string, bool) {
+	now := time.Now()
+	victim, found := "", false
+	var lowest uint8
+
+	sampled := 0
+	// map iteration starts at a random position, which makes it a cheap sample
+	for key, entry := range policy.entries {
+		if sampled == lfuSampleSize {
+			break
+		}
+		sampled++
+
+		counter := entry.decayedCounter(now)
+		if !found || counter < lowest {
+			victim, lowest, found = key, counter, true
+		}
+	}
+	return victim, found
+}
+
+// randomPolicy evicts an arbitrary key.
+type randomPolicy struct {
+	keys map[string]struct{}
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{keys: make(map[string]struct{})}
+}
+
+func (policy *randomPolicy) add(key string, node cacheNode) {
+	policy.keys[key] = struct{}{}
+}
+
+func (policy *randomPolicy) access(key string) {}
+
+func (policy *randomPolicy) remove(key string) {
+	delete(policy.keys, key)
+}
+
+func (policy *randomPolicy) evictable(key string) bool {
+	_, ok := policy.keys[key]
+	return ok
+}
+
+func (policy *randomPolicy) victim() (string, bool) {
+	for key := range policy.keys {
+		return key, true
+	}
+	return "", false
+}
+
+// volatilePolicy restricts another policy to keys holding an expiry.
+type volatilePolicy struct {
+	policy evictionPolicy
+}
+
+func newVolatilePolicy(policy evictionPolicy) *volatilePolicy {
+	return &volatilePolicy{policy: policy}
+}
+
+func (volatile *volatilePolicy) add(key string, node cacheNode) {
+	if node.Expiry.IsZero() {
+		volatile.policy.remove(key)
+		return
+	}
+	volatile.policy.add(key, node)
+}
+
+func (volatile *volatilePolicy) access(key string) {
+	volatile.policy.access(key)
+}
+
+func (volatile *volatilePolicy) remove(key string) {
+	volatile.policy.remove(key)
+}
+
+func (volatile *volatilePolicy) evictable(key string) bool {
+	return volatile.policy.evictable(key)
+}
+
+func (volatile *volatilePolicy) victim() (string, bool) {
+	return volatile.policy.victim()
+}
+
+// noEvictionPolicy never evicts, writes fail once the cache is full.
+type noEvictionPolicy struct{}
+
+func (noEvictionPolicy) add(key string, node cacheNode) {}
+
+func (noEvictionPolicy) access(key string) {}
+
+func (noEvictionPolicy) remove(key string) {}
+
+func (noEvictionPolicy) evictable(key string) bool {
+	return false
+}
+
+func (noEvictionPolicy) victim() (string, bool) {
+	return "", false
+}
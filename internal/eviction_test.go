@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fullCache returns a single shard cache holding its maximum of keys key:0 to key:15, oldest first
+func fullCache(t *testing.T, policy string, ttl func(i int) time.Duration) *cache {
+	t.Helper()
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 1
+		config.NodeLimit = minNodesPerShard
+		config.TimeToLive = 0
+		config.EvictionPolicy = policy
+	})
+	for i := range minNodesPerShard {
+		err := cache.Set(fmt.Sprintf("key:%d", i), []byte("value"), ttl(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cache
+}
+
+func noExpiry(int) time.Duration { return 0 }
+
+func exists(cache *cache, key string) bool {
+	_, ok, _ := cache.Get(key)
+	return ok
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		ttl     func(i int) time.Duration
+		evicted string
+	}{
+		// key:0 and key:1 are the oldest but were just read
+		{"allkeys-lru", noExpiry, "key:2"},
+		{"allkeys-fifo", noExpiry, "key:0"},
+		// only the odd keys have an expiry
+		{"volatile-lru", func(i int) time.Duration { return time.Duration(i%2) * time.Hour }, "key:3"},
+		{"volatile-fifo", func(i int) time.Duration { return time.Duration(i%2) * time.Hour }, "key:1"},
+	}
+
+	for _, test := range tests {
+		cache := fullCache(t, test.policy, test.ttl)
+		for i := range minNodesPerShard {
+			cache.Get(fmt.Sprintf("key:%d", i))
+		}
+		cache.Get("key:0")
+		cache.Get("key:1")
+
+		err := cache.Set("new", []byte("value"), 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.policy, err)
+			continue
+		}
+		if exists(cache, test.evicted) {
+			t.Errorf("%s: %s wasn't evicted", test.policy, test.evicted)
+		}
+		if cache.Size() != minNodesPerShard {
+			t.Errorf("%s: %d keys after evicting", test.policy, cache.Size())
+		}
+	}
+}
+
+func TestLFUEvictsTheLeastUsedKey(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 1
+		config.NodeLimit = minNodesPerShard
+		config.TimeToLive = 0
+		config.EvictionPolicy = "allkeys-lfu"
+	})
+	// every key is sampled once the cache holds no more than a sample
+	policy := cache.shards[0].policy.(*lfuPolicy)
+	for i := range lfuSampleSize {
+		key := fmt.Sprintf("key:%d", i)
+		cache.Set(key, []byte("value"), 0)
+		if i > 0 {
+			policy.entries[key].counter = 200
+		}
+	}
+
+	victim, _ := policy.victim()
+	if victim != "key:0" {
+		t.Errorf("evicted %s instead of the least used key", victim)
+	}
+}
+
+func TestNoEvictionFailsWrites(t *testing.T) {
+	cache := fullCache(t, "noeviction", noExpiry)
+	if err := cache.Set("new", []byte("value"), 0); err == nil {
+		t.Error("a write past the node limit succeeded")
+	}
+	if err := cache.Set("key:0", []byte("overwritten"), 0); err != nil {
+		t.Errorf("overwriting a key failed: %s", err)
+	}
+}
+
+func TestVolatilePolicyWithoutVolatileKeys(t *testing.T) {
+	cache := fullCache(t, "volatile-lru", noExpiry)
+	if err := cache.Set("new", []byte("value"), 0); err == nil {
+		t.Error("a key without expiry was evicted")
+	}
+}
+
+func TestByteLimitEviction(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 1
+		config.TimeToLive = 0
+		config.CacheLimit = 4096
+	})
+	value := make([]byte, 512)
+	for i := range 20 {
+		err := cache.Set(fmt.Sprintf("key:%d", i), value, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bytes := cache.shards[0].CumulativeBytes; bytes > 4096 {
+		t.Errorf("the cache holds %d bytes over its limit", bytes)
+	}
+	if !exists(cache, "key:19") || exists(cache, "key:0") {
+		t.Error("the oldest keys weren't the ones evicted")
+	}
+}
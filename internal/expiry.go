@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the active expiry cycle runs
+	expiryCycleInterval = 100 * time.Millisecond
+	// Number of keys with an expiry inspected per sampling round
+	expirySampleSize = 20
+	// A new round is sampled while more than this percentage of the last one had expired
+	expiryRepeatPercentage = 25
+	// Upper bound of time spent reclaiming keys in a single cycle
+	expiryCycleBudget = 25 * time.Millisecond
+)
+
+type cacheStats struct {
+	expiredKeys  atomic.Uint64
+	expiredBytes atomic.Uint64
+	expiryCycles atomic.Uint64
+	evictedKeys  atomic.Uint64
+	evictedBytes atomic.Uint64
+}
+
+// expireNode removes an expired key and records it in the cache stats.
+// Must be called with the write lock held.
+func (shard *cacheShard) expireNode(key string) {
+	node, ok := shard.Data[key]
+	if !ok {
+		return
+	}
+
+	shard.cache.stats.expiredKeys.Add(1)
+	shard.cache.stats.expiredBytes.Add(uint64(node.size))
+	shard.discard(key)
+	shard.cache.notify(eventExpired, key)
+}
+
+// sampleExpired inspects up to expirySampleSize keys holding an expiry and
+// removes the expired ones. Returns how many keys were sampled and reclaimed.
+func (shard *cacheShard) sampleExpired(now time.Time) (int, int) {
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	sampled, reclaimed := 0, 0
+	// map iteration starts at a random position, which makes it a cheap sample
+	for key := range shard.volatile {
+		if sampled == expirySampleSize {
+			break
+		}
+		sampled++
+
+		if shard.Data[key].expired(now) {
+			shard.expireNode(key)
+			reclaimed++
+		}
+	}
+	return sampled, reclaimed
+}
+
+// activeExpiryCycle reclaims expired keys that are never read again.
+// Each shard is sampled again while a large share of its keys turn out to be
+// expired, bounded by expiryCycleBudget so clients are never starved. A cycle
+// that runs out of budget resumes from the shard it stopped at.
+func (cache *cache) activeExpiryCycle() {
+	start := time.Now()
+	cache.stats.expiryCycles.Add(1)
+	cache.locks.releaseExpired(start)
+
+	for visited := 0; visited < len(cache.shards); visited++ {
+		shard := cache.shards[cache.expiryShard]
+		for {
+			if time.Since(start) > expiryCycleBudget {
+				return
+			}
+
+			sampled, reclaimed := shard.sampleExpired(time.Now())
+			if sampled == 0 || reclaimed*100 <= sampled*expiryRepeatPercentage {
+				break
+			}
+		}
+		cache.expiryShard = (cache.expiryShard + 1) % len(cache.shards)
+	}
+}
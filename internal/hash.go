@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// newHashNode returns an empty hash with the default time to live
+func (cache *cache) newHashNode(now time.Time) cacheNode {
+	return cacheNode{
+		Kind:   hashKind,
+		Hash:   make(map[string]string),
+		Expiry: expiryFrom(now, cache.defaultTimeToLive()),
+	}
+}
+
+// HashSet sets every field to the value at the same index, creating the hash if needed.
+// An existing hash keeps its expiry. Returns how many fields were added.
+func (cache *cache) HashSet(key string, fields, values []string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, hashKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cache.newHashNode(now)
+	}
+
+	// size the hash as it will be after the write before touching it
+	pending := make(map[string]string, len(fields))
+	for i, field := range fields {
+		pending[field] = values[i]
+	}
+	elementBytes, added := int(node.elementBytes), 0
+	for field, value := range pending {
+		if previous, ok := node.Hash[field]; ok {
+			elementBytes += len(value) - len(previous)
+		} else {
+			elementBytes += len(field) + len(value)
+			added++
+		}
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, len(node.Hash)+added))
+	if err != nil {
+		return 0, err
+	}
+
+	for field, value := range pending {
+		node.Hash[field] = value
+	}
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	return added, nil
+}
+
+// HashGet returns the value of field in the hash stored under key.
+func (cache *cache) HashGet(key, field string) (string, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, hashKind, time.Now())
+	if !ok || err != nil {
+		return "", false, err
+	}
+
+	shard.policy.access(key)
+	value, ok := node.Hash[field]
+	return value, ok, nil
+}
+
+// HashDelete removes fields from the hash stored under key, an emptied hash is deleted.
+// Returns how many fields were removed.
+func (cache *cache) HashDelete(key string, fields []string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, hashKind, time.Now())
+	if !ok || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, field := range fields {
+		if value, ok := node.Hash[field]; ok {
+			node.elementBytes -= uint32(len(field) + len(value))
+			delete(node.Hash, field)
+			removed++
+		}
+	}
+
+	if len(node.Hash) == 0 {
+		shard.remove(key)
+	} else if removed > 0 {
+		shard.commit(key, node)
+	}
+	return removed, nil
+}
+
+// HashGetAll returns the fields and values of the hash stored under key as
+// alternating items, ordered by field.
+func (cache *cache) HashGetAll(key string) ([]string, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, hashKind, time.Now())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	shard.policy.access(key)
+	fields := make([]string, 0, len(node.Hash))
+	for field := range node.Hash {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	items := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		items = append(items, field, node.Hash[field])
+	}
+	return items, nil
+}
+
+// HashIncrementBy adds delta to the integer stored in field, a missing field counts as 0.
+func (cache *cache) HashIncrementBy(key, field string, delta int64) (int64, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, hashKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cache.newHashNode(now)
+	}
+
+	var current int64
+	previous, ok := node.Hash[field]
+	if ok {
+		current, err = strconv.ParseInt(previous, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("hash value is not an integer")
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) ||
+		(delta < 0 && current < math.MinInt64-delta) {
+		return 0, fmt.Errorf("increment or decrement would overflow")
+	}
+
+	result := current + delta
+	value := strconv.FormatInt(result, 10)
+
+	elementBytes, elements := int(node.elementBytes)+len(value), len(node.Hash)
+	if ok {
+		elementBytes -= len(previous)
+	} else {
+		elementBytes += len(field)
+		elements++
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, elements))
+	if err != nil {
+		return 0, err
+	}
+
+	node.Hash[field] = value
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	return result, nil
+}
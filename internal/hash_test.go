@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// cachedBytes is the memory accounted over every shard of cache
+func cachedBytes(cache *cache) uint32 {
+	var total uint32
+	for _, shard := range cache.shards {
+		total += shard.CumulativeBytes
+	}
+	return total
+}
+
+func TestHashCommands(t *testing.T) {
+	cache := newTestCache(nil)
+
+	if added, _ := cache.HashSet("user", []string{"name", "role"}, []string{"ada", "admin"}); added != 2 {
+		t.Errorf("HSET added %d fields", added)
+	}
+	// a field set twice in one call counts once, with the last value
+	if added, _ := cache.HashSet("user", []string{"role", "team", "team"}, []string{"owner", "a", "b"}); added != 1 {
+		t.Errorf("HSET added %d fields", added)
+	}
+	if value, ok, _ := cache.HashGet("user", "team"); !ok || value != "b" {
+		t.Errorf("HGET returned %q, %t", value, ok)
+	}
+	if _, ok, _ := cache.HashGet("user", "missing"); ok {
+		t.Error("HGET found a missing field")
+	}
+
+	items, _ := cache.HashGetAll("user")
+	if !slices.Equal(items, []string{"name", "ada", "role", "owner", "team", "b"}) {
+		t.Errorf("HGETALL returned %q", items)
+	}
+
+	if removed, _ := cache.HashDelete("user", []string{"name", "missing"}); removed != 1 {
+		t.Errorf("HDEL removed %d fields", removed)
+	}
+	cache.HashDelete("user", []string{"role", "team"})
+	if cache.Size() != 0 || cachedBytes(cache) != 0 {
+		t.Errorf("an emptied hash is still stored with %d bytes", cachedBytes(cache))
+	}
+}
+
+func TestHashIncrementBy(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		delta    int64
+		expected int64
+		valid    bool
+	}{
+		{"missing field", "", 3, 3, true},
+		{"existing field", "10", -4, 6, true},
+		{"overflow", "9223372036854775807", 1, 0, false},
+		{"text", "ten", 1, 0, false},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(nil)
+		cache.HashSet("stats", []string{"other"}, []string{"1"})
+		if test.initial != "" {
+			cache.HashSet("stats", []string{"count"}, []string{test.initial})
+		}
+
+		result, err := cache.HashIncrementBy("stats", "count", test.delta)
+		if (err == nil) != test.valid || result != test.expected {
+			t.Errorf("%s: got %d, %v", test.name, result, err)
+		}
+	}
+}
+
+func TestHashAccounting(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.NodeSize = 64
+	})
+
+	cache.HashSet("hash", []string{"field"}, []string{"value"})
+	cache.HashSet("hash", []string{"field"}, []string{"longer value"})
+	cache.HashIncrementBy("hash", "count", 100)
+	node := cache.shardFor("hash").Data["hash"]
+	if expected := node.byteSize("hash"); cachedBytes(cache) != expected {
+		t.Errorf("%d bytes accounted for a hash of %d", cachedBytes(cache), expected)
+	}
+
+	if _, err := cache.HashSet("hash", []string{"large"}, []string{strings.Repeat("x", 64)}); err == nil {
+		t.Error("a hash larger than the node size was stored")
+	}
+	if value, _, _ := cache.HashGet("hash", "field"); value != "longer value" {
+		t.Errorf("a refused HSET changed the hash to %q", value)
+	}
+
+	cache.Set("text", []byte("value"), 0)
+	if _, err := cache.HashSet("text", []string{"field"}, []string{"value"}); !errors.Is(err, errWrongType) {
+		t.Errorf("HSET on a string: got %v", err)
+	}
+	if _, _, err := cache.Get("hash"); !errors.Is(err, errWrongType) {
+		t.Errorf("GET on a hash: got %v", err)
+	}
+}
+
+func TestHashRequests(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"HSET", "user", "name", "ada lovelace", "visits", "1"}, "INTEGER 2"},
+		{[]string{"HSET", "user", "name"}, "ERR wrong number of arguments for HSET"},
+		{[]string{"HGET", "user", "name"}, "VALUE ada lovelace"},
+		{[]string{"HGET", "user", "missing"}, "NOT_FOUND"},
+		{[]string{"HINCRBY", "user", "visits", "41"}, "INTEGER 42"},
+		{[]string{"HINCRBY", "user", "visits", "x"}, "ERR value is not an integer"},
+		{[]string{"HGETALL", "user"}, "VALUES 4 $4 name $12 ada lovelace $6 visits $2 42"},
+		{[]string{"HDEL", "user", "name", "visits"}, "INTEGER 2"},
+		{[]string{"HGETALL", "user"}, "VALUES 0"},
+		{[]string{"SET", "text", "value"}, "OK"},
+		{[]string{"HGET", "text", "field"}, "ERR " + errWrongType.Error()},
+	}
+	for _, test := range tests {
+		expectReply(t, strings.Join(test.args, " "), client.do(test.args...), test.expected)
+	}
+}
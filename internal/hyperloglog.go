@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// 2^14 registers give a standard error of 0.81%
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	// Dense registers are packed 6 bits each, enough for ranks up to 64-hllPrecision+1
+	hllRegisterBits = 6
+	hllRegisterMask = 1<<hllRegisterBits - 1
+	hllDenseBytes   = hllRegisters * hllRegisterBits / 8
+	// The encoding byte and dense registers, shards are sized to fit it next to any key
+	hllMaxBytes = 1 + hllDenseBytes
+	// A sparse entry packs a register index and its value in 3 bytes
+	hllSparseEntryBytes = 3
+)
+
+// HyperLogLog nodes keep their encoding in the first byte of Bits. Sparse ones
+// list the registers set so far, which keeps small counters to a few bytes,
+// dense ones hold every register.
+const (
+	hllSparse byte = iota
+	hllDense
+)
+
+// decodeHyperLogLog unpacks the registers of a HyperLogLog node, nil reads as an empty one
+func decodeHyperLogLog(encoded []byte) []uint8 {
+	registers := make([]uint8, hllRegisters)
+	if len(encoded) == 0 {
+		return registers
+	}
+
+	data := encoded[1:]
+	if encoded[0] == hllDense {
+		for i := range registers {
+			bit := i * hllRegisterBits
+			word := uint16(data[bit/8])
+			if bit/8+1 < len(data) {
+				word |= uint16(data[bit/8+1]) << 8
+			}
+			registers[i] = uint8(word>>(bit%8)) & hllRegisterMask
+		}
+		return registers
+	}
+
+	for i := 0; i+hllSparseEntryBytes <= len(data); i += hllSparseEntryBytes {
+		entry := uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])
+		registers[(entry>>hllRegisterBits)%hllRegisters] = uint8(entry & hllRegisterMask)
+	}
+	return registers
+}
+
+// encodeHyperLogLog packs registers in whichever encoding is smaller
+func encodeHyperLogLog(registers []uint8) []byte {
+	used := 0
+	for _, register := range registers {
+		if register != 0 {
+			used++
+		}
+	}
+
+	if used*hllSparseEntryBytes < hllDenseBytes {
+		encoded := make([]byte, 1, 1+used*hllSparseEntryBytes)
+		encoded[0] = hllSparse
+		for i, register := range registers {
+			if register != 0 {
+				entry := uint32(i)<<hllRegisterBits | uint32(register)
+				encoded = append(encoded, byte(entry>>16), byte(entry>>8), byte(entry))
+			}
+		}
+		return encoded
+	}
+
+	encoded := make([]byte, hllMaxBytes)
+	encoded[0] = hllDense
+	data := encoded[1:]
+	for i, register := range registers {
+		bit := i * hllRegisterBits
+		data[bit/8] |= register << (bit % 8)
+		if bit%8 > 8-hllRegisterBits {
+			data[bit/8+1] |= register >> (8 - bit%8)
+		}
+	}
+	return encoded
+}
+
+// hllPosition returns the register of element and its rank, the position of
+// the first set bit in the rest of the element hash
+func hllPosition(element string) (int, uint8) {
+	hash := mix64(hashKey(element))
+	rest := hash<<hllPrecision | 1<<(hllPrecision-1)
+	return int(hash >> (64 - hllPrecision)), uint8(bits.LeadingZeros64(rest) + 1)
+}
+
+// hllEstimate is the estimated number of distinct elements counted by registers
+func hllEstimate(registers []uint8) uint64 {
+	size := float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, register := range registers {
+		sum += math.Ldexp(1, -int(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/size)
+	estimate := alpha * size * size / sum
+	// the raw estimate is biased while many registers are still empty,
+	// linear counting over the empty ones is more accurate there
+	if estimate <= 2.5*size && zeros > 0 {
+		estimate = size * math.Log(size/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// storeHyperLogLog encodes registers into node and stores it under key.
+// Only the key counts against the node size limit, the registers never grow past
+// hllMaxBytes which every shard leaves room for.
+// Must be called with the write lock of shard held.
+func (cache *cache) storeHyperLogLog(shard *cacheShard, key string, node cacheNode, registers []uint8) error {
+	err := cache.checkDataSize(key, 0)
+	if err != nil {
+		return err
+	}
+	node.Bits = encodeHyperLogLog(registers)
+	return shard.put(key, node)
+}
+
+// HyperLogLogAdd counts elements in the HyperLogLog stored under key, creating it if needed.
+// Returns true if the key was created or its estimate may have changed.
+func (cache *cache) HyperLogLogAdd(key string, elements []string) (bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, hllKind, now)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		node = cacheNode{Kind: hllKind, Expiry: expiryFrom(now, cache.defaultTimeToLive())}
+	}
+
+	registers := decodeHyperLogLog(node.Bits)
+	changed := !exists
+	for _, element := range elements {
+		index, rank := hllPosition(element)
+		if rank > registers[index] {
+			registers[index] = rank
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, cache.storeHyperLogLog(shard, key, node, registers)
+}
+
+// unionHyperLogLogs merges the registers of the HyperLogLogs stored under keys, missing keys read as empty.
+// Must be called with the write lock of every shard of keys held.
+func (cache *cache) unionHyperLogLogs(keys []string, now time.Time) ([]uint8, error) {
+	union := make([]uint8, hllRegisters)
+	for _, key := range keys {
+		shard := cache.shardFor(key)
+		node, ok, err := shard.lookupKind(key, hllKind, now)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		shard.policy.access(key)
+		for i, register := range decodeHyperLogLog(node.Bits) {
+			union[i] = max(union[i], register)
+		}
+	}
+	return union, nil
+}
+
+// HyperLogLogCount estimates the number of distinct elements counted by any of the HyperLogLogs stored under keys.
+func (cache *cache) HyperLogLogCount(keys []string) (uint64, error) {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	registers, err := cache.unionHyperLogLogs(keys, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return hllEstimate(registers), nil
+}
+
+// HyperLogLogMerge stores under destination the union of itself and the HyperLogLogs under sources.
+// An existing destination keeps its expiry.
+func (cache *cache) HyperLogLogMerge(destination string, sources []string) error {
+	keys := append([]string{destination}, sources...)
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	registers, err := cache.unionHyperLogLogs(keys, now)
+	if err != nil {
+		return err
+	}
+
+	shard := cache.shardFor(destination)
+	node, exists := shard.lookup(destination, now)
+	if !exists {
+		node = cacheNode{Kind: hllKind, Expiry: expiryFrom(now, cache.defaultTimeToLive())}
+	}
+	return cache.storeHyperLogLog(shard, destination, node, registers)
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestHyperLogLogEncoding(t *testing.T) {
+	for _, count := range []int{0, 1, 100, 5000} {
+		registers := make([]uint8, hllRegisters)
+		for i := range count {
+			index, rank := hllPosition(fmt.Sprint(i))
+			registers[index] = max(registers[index], rank)
+		}
+
+		encoded := encodeHyperLogLog(registers)
+		if !slices.Equal(decodeHyperLogLog(encoded), registers) {
+			t.Errorf("%d elements: registers changed through encoding %d", count, encoded[0])
+		}
+		if len(encoded) > hllMaxBytes {
+			t.Errorf("%d elements: encoded to %d bytes", count, len(encoded))
+		}
+	}
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	cache := newTestCache(nil)
+	added := 0
+	for _, count := range []int{1, 10, 350, 1000, 20000, 100000} {
+		elements := make([]string, 0, count-added)
+		for ; added < count; added++ {
+			elements = append(elements, fmt.Sprintf("visitor:%d", added))
+		}
+		// the default node size is far below a dense HyperLogLog
+		_, err := cache.HyperLogLogAdd("visitors", elements)
+		if err != nil {
+			t.Fatalf("%d elements: %s", count, err)
+		}
+
+		estimate, err := cache.HyperLogLogCount([]string{"visitors"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deviation := math.Abs(float64(estimate)-float64(count)) / float64(count); deviation > 0.03 {
+			t.Errorf("%d elements: estimated %d", count, estimate)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	cache := newTestCache(nil)
+	cache.HyperLogLogAdd("a", []string{"1", "2", "3"})
+	cache.HyperLogLogAdd("b", []string{"3", "4"})
+
+	if changed, _ := cache.HyperLogLogAdd("a", []string{"1"}); changed {
+		t.Error("adding a counted element reported a change")
+	}
+	if estimate, _ := cache.HyperLogLogCount([]string{"a", "b", "missing"}); estimate != 4 {
+		t.Errorf("union estimated %d", estimate)
+	}
+	if err := cache.HyperLogLogMerge("union", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if estimate, _ := cache.HyperLogLogCount([]string{"union"}); estimate != 4 {
+		t.Errorf("merge estimated %d", estimate)
+	}
+}
+
+func TestHyperLogLogFitsSmallLimits(t *testing.T) {
+	tests := []struct {
+		nodeSize   uint16
+		cacheLimit uint32
+	}{
+		{64, 64 << 10},
+		{1024, 256 << 10},
+		{1024, 5 << 20},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(func(config *poolConfig) {
+			config.NodeSize = test.nodeSize
+			config.CacheLimit = test.cacheLimit
+		})
+		// fill every shard with strings before the HyperLogLog turns dense among them
+		for i := range 4000 {
+			cache.Set(fmt.Sprintf("filler:%d", i), make([]byte, test.nodeSize/2), 0)
+		}
+
+		elements := make([]string, 20000)
+		for i := range elements {
+			elements[i] = fmt.Sprint(i)
+		}
+		if _, err := cache.HyperLogLogAdd("visitors", elements); err != nil {
+			t.Errorf("node size %d, cache limit %d: %s", test.nodeSize, test.cacheLimit, err)
+		}
+	}
+
+	cache := newTestCache(func(config *poolConfig) {
+		config.NodeSize = 64
+	})
+	if _, err := cache.HyperLogLogAdd(string(make([]byte, 65)), []string{"1"}); err == nil {
+		t.Error("a key longer than the node size was stored")
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import "fmt"
+
+// keyspaceEvent is a change to a key that can be published to subscribers
+type keyspaceEvent uint8
+
+const (
+	// A key was written by any verb
+	eventSet keyspaceEvent = 1 << iota
+	// A key was deleted by a verb, including collections emptied by one
+	eventDel
+	// A key reached its expiry
+	eventExpired
+	// A key was evicted to make room for another
+	eventEvicted
+)
+
+var keyspaceEventNames = map[keyspaceEvent]string{
+	eventSet:     "set",
+	eventDel:     "del",
+	eventExpired: "expired",
+	eventEvicted: "evicted",
+}
+
+// parseKeyspaceEvents combines the named events into a mask, "all" enables every event
+func parseKeyspaceEvents(names []string) (keyspaceEvent, error) {
+	var events keyspaceEvent
+	for _, name := range names {
+		if name == "all" {
+			events |= eventSet | eventDel | eventExpired | eventEvicted
+			continue
+		}
+
+		found := false
+		for event, eventName := range keyspaceEventNames {
+			if eventName == name {
+				events |= event
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown keyspace event '%s'", name)
+		}
+	}
+	return events, nil
+}
+
+// notify publishes event on key when it is enabled. Every event goes to
+// "__keyspace__:<key>" with the event name as message and to
+// "__keyevent__:<event>" with the key as message.
+// Called with the shard lock held, publishing never waits on subscribers.
+func (cache *cache) notify(event keyspaceEvent, key string) {
+	if cache.events&event == 0 {
+		return
+	}
+
+	name := keyspaceEventNames[event]
+	cache.pubsub.Publish("__keyspace__:"+key, name)
+	cache.pubsub.Publish("__keyevent__:"+name, key)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		names    []string
+		expected keyspaceEvent
+		valid    bool
+	}{
+		{nil, 0, true},
+		{[]string{"set"}, eventSet, true},
+		{[]string{"del", "expired"}, eventDel | eventExpired, true},
+		{[]string{"evicted", "all"}, eventSet | eventDel | eventExpired | eventEvicted, true},
+		{[]string{"set", "touched"}, 0, false},
+	}
+	for _, test := range tests {
+		events, err := parseKeyspaceEvents(test.names)
+		if (err == nil) != test.valid || events != test.expected {
+			t.Errorf("%q: got %b, %v", test.names, events, err)
+		}
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []string
+		change   func(cache *cache)
+		expected []string
+	}{
+		{"set", []string{"set"}, func(cache *cache) {
+			cache.Set("key", []byte("value"), 0)
+		}, []string{"__keyspace__:key set", "__keyevent__:set key"}},
+		{"hash field", []string{"set"}, func(cache *cache) {
+			cache.HashSet("hash", []string{"field"}, []string{"value"})
+		}, []string{"__keyspace__:hash set", "__keyevent__:set hash"}},
+		{"del", []string{"del"}, func(cache *cache) {
+			cache.Set("key", []byte("value"), 0)
+			cache.Delete("key")
+			cache.Delete("missing")
+		}, []string{"__keyspace__:key del", "__keyevent__:del key"}},
+		{"emptied collection", []string{"del"}, func(cache *cache) {
+			cache.Push("list", []string{"item"}, true)
+			cache.Pop("list", true)
+		}, []string{"__keyspace__:list del", "__keyevent__:del list"}},
+		{"expired", []string{"expired"}, func(cache *cache) {
+			cache.Set("key", []byte("value"), time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+			cache.Get("key")
+		}, []string{"__keyspace__:key expired", "__keyevent__:expired key"}},
+		{"evicted", []string{"evicted"}, func(cache *cache) {
+			for i := range minNodesPerShard + 1 {
+				cache.Set(fmt.Sprintf("key:%d", i), []byte("value"), 0)
+			}
+		}, []string{"__keyspace__:key:0 evicted", "__keyevent__:evicted key:0"}},
+		{"disabled", []string{"del"}, func(cache *cache) {
+			cache.Set("key", []byte("value"), 0)
+		}, nil},
+	}
+
+	for _, test := range tests {
+		cache := newTestCache(func(config *poolConfig) {
+			config.Shards = 1
+			config.NodeLimit = minNodesPerShard
+			config.EvictionPolicy = "allkeys-lru"
+			config.KeyspaceEvents = test.events
+		})
+		listener := newSubscriber(0)
+		cache.pubsub.subscribe(listener, []string{"__key*"}, true)
+		queued(listener)
+
+		test.change(cache)
+		var notifications []string
+		for _, message := range queued(listener) {
+			var verb, pattern, channel, length, event string
+			fmt.Sscan(message, &verb, &pattern, &channel, &length, &event)
+			notifications = append(notifications, channel+" "+event)
+		}
+		if !slices.Equal(notifications, test.expected) {
+			t.Errorf("%s: got %q", test.name, notifications)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"slices"
+	"time"
+)
+
+// Push adds values to the head (left) or tail of the list stored under key, creating it if needed.
+// Values pushed to the head end up in reverse order. Returns the new length of the list.
+func (cache *cache) Push(key string, values []string, left bool) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, listKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cacheNode{
+			Kind:   listKind,
+			List:   newDeque(nil),
+			Expiry: expiryFrom(now, cache.defaultTimeToLive()),
+		}
+	}
+
+	elementBytes := int(node.elementBytes)
+	for _, value := range values {
+		elementBytes += len(value)
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, node.List.length()+len(values)))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, value := range values {
+		if left {
+			node.List.pushFront(value)
+		} else {
+			node.List.pushBack(value)
+		}
+	}
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	shard.wake(key)
+	return node.List.length(), nil
+}
+
+// Pop removes and returns the first (left) or last element of the list stored under key.
+func (cache *cache) Pop(key string, left bool) (string, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, listKind, time.Now())
+	if !ok || err != nil {
+		return "", false, err
+	}
+	return shard.pop(key, node, left), true, nil
+}
+
+// pop removes an element from the non empty list node stored under key, an emptied list is deleted.
+// Must be called with the write lock held.
+func (shard *cacheShard) pop(key string, node cacheNode, left bool) string {
+	var value string
+	if left {
+		value = node.List.popFront()
+	} else {
+		value = node.List.popBack()
+	}
+
+	if node.List.length() == 0 {
+		shard.remove(key)
+		return value
+	}
+
+	node.elementBytes -= uint32(len(value))
+	shard.commit(key, node)
+	return value
+}
+
+// BlockingPop pops from the first non empty list among keys, waiting up to timeout for
+// one of them to be pushed to. A zero timeout waits until done or disconnected is closed.
+// Returns the key the value was popped from, false if nothing arrived in time.
+func (cache *cache) BlockingPop(keys []string, left bool, timeout time.Duration, done, disconnected <-chan struct{}) (string, string, bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	wake := make(chan struct{}, 1)
+	for {
+		gate := cache.enterGate(keys[0])
+		shards := cache.lockShards(keys)
+		key, value, ok, err := cache.popFirst(keys, left)
+		if ok || err != nil {
+			unlockShards(shards)
+			gate.RUnlock()
+			return key, value, ok, err
+		}
+		for _, key := range keys {
+			shard := cache.shardFor(key)
+			shard.waiters[key] = append(shard.waiters[key], wake)
+		}
+		unlockShards(shards)
+		gate.RUnlock()
+
+		woken := false
+		select {
+		case <-wake:
+			woken = true
+		case <-expired:
+		case <-done:
+		case <-disconnected:
+		}
+
+		cache.stopWaiting(keys, wake)
+		if !woken {
+			return "", "", false, nil
+		}
+	}
+}
+
+// popFirst pops from the first non empty list among keys.
+// Must be called with the write locks of the shards holding keys.
+func (cache *cache) popFirst(keys []string, left bool) (string, string, bool, error) {
+	now := time.Now()
+	for _, key := range keys {
+		shard := cache.shardFor(key)
+		node, ok, err := shard.lookupKind(key, listKind, now)
+		if err != nil {
+			return "", "", false, err
+		}
+		if ok {
+			return key, shard.pop(key, node, left), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// stopWaiting unregisters wake from the waiters of keys
+func (cache *cache) stopWaiting(keys []string, wake chan struct{}) {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	for _, key := range keys {
+		shard := cache.shardFor(key)
+		waiters := slices.DeleteFunc(shard.waiters[key], func(waiter chan struct{}) bool {
+			return waiter == wake
+		})
+		if len(waiters) == 0 {
+			delete(shard.waiters, key)
+		} else {
+			shard.waiters[key] = waiters
+		}
+	}
+}
+
+// wake signals every connection blocked on key, they race to pop once the lock is released.
+// Must be called with the write lock held.
+func (shard *cacheShard) wake(key string) {
+	for _, waiter := range shard.waiters[key] {
+		select {
+		case waiter <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// listRange clamps the inclusive start and stop indexes, negative ones counting
+// from the tail, to a list of length elements. Returns false if the range is empty.
+func listRange(length, start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, start <= stop && start < length
+}
+
+// Range returns the elements of the list stored under key between start and stop inclusive.
+func (cache *cache) Range(key string, start, stop int) ([]string, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, listKind, time.Now())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	shard.policy.access(key)
+	start, stop, ok = listRange(node.List.length(), start, stop)
+	if !ok {
+		return nil, nil
+	}
+	return node.List.slice(start, stop+1), nil
+}
+
+// Length returns the number of elements of the list stored under key.
+func (cache *cache) Length(key string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, _, err := shard.lookupKind(key, listKind, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if node.List == nil {
+		return 0, nil
+	}
+	return node.List.length(), nil
+}
+
+// Trim keeps only the elements of the list stored under key between start and stop inclusive.
+func (cache *cache) Trim(key string, start, stop int) error {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, listKind, time.Now())
+	if !ok || err != nil {
+		return err
+	}
+
+	start, stop, ok = listRange(node.List.length(), start, stop)
+	if !ok {
+		shard.remove(key)
+		return nil
+	}
+
+	node.List = newDeque(node.List.slice(start, stop+1))
+	node.recount()
+	shard.commit(key, node)
+	return nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestListCommands(t *testing.T) {
+	cache := newTestCache(nil)
+	cache.Push("list", []string{"b", "c"}, false)
+	if length, _ := cache.Push("list", []string{"a", "z"}, true); length != 4 {
+		t.Errorf("pushed to a length of %d", length)
+	}
+
+	if items, _ := cache.Range("list", 0, -1); !slices.Equal(items, []string{"z", "a", "b", "c"}) {
+		t.Errorf("list holds %q", items)
+	}
+	cache.Trim("list", 1, -1)
+	if value, ok, _ := cache.Pop("list", false); !ok || value != "c" {
+		t.Errorf("popped %q", value)
+	}
+	cache.Pop("list", true)
+	cache.Pop("list", true)
+	if length, _ := cache.Length("list"); length != 0 || cache.Size() != 0 {
+		t.Errorf("an emptied list is still stored with %d elements", length)
+	}
+}
+
+func TestPushHeadIsConstantTime(t *testing.T) {
+	cache := newTestCache(func(config *poolConfig) {
+		config.Shards = 1
+		config.CacheLimit = 1 << 30
+	})
+	const count = 200000
+	start := time.Now()
+	// empty elements stay within the node size limit
+	for range count {
+		_, err := cache.Push("list", []string{""}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache.Push("list", []string{"head"}, true)
+	// copying the list on every push takes minutes for this many elements
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("%d pushes to the head took %v", count, elapsed)
+	}
+	if items, _ := cache.Range("list", 0, 1); !slices.Equal(items, []string{"head", ""}) {
+		t.Errorf("the list starts with %q", items)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	cache := newTestCache(nil)
+	done := make(chan struct{})
+
+	popped := make(chan string)
+	go func() {
+		key, value, _, _ := cache.BlockingPop([]string{"first", "second"}, true, 0, done, nil)
+		popped <- key + "=" + value
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cache.Push("second", []string{"value"}, true)
+
+	select {
+	case result := <-popped:
+		if result != "second=value" {
+			t.Errorf("popped %s", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a push didn't wake the blocked pop")
+	}
+
+	start := time.Now()
+	_, _, ok, _ := cache.BlockingPop([]string{"first"}, true, 30*time.Millisecond, done, nil)
+	if ok || time.Since(start) < 30*time.Millisecond {
+		t.Error("a pop with a timeout didn't wait for it")
+	}
+
+	disconnected := make(chan struct{})
+	close(disconnected)
+	if _, _, ok, _ := cache.BlockingPop([]string{"first"}, true, 0, done, disconnected); ok {
+		t.Error("a pop for a disconnected client returned a value")
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// lease is a held lock, released by its token or once it expires
+type lease struct {
+	token  uint64
+	expiry time.Time
+}
+
+// lockTable holds the named locks apart from the keyspace so they are never
+// evicted. Tokens are drawn from the cache version counter, floored at the
+// clock so they keep increasing across restarts, backups or not.
+type lockTable struct {
+	mutex  sync.Mutex
+	leases map[string]lease
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{leases: make(map[string]lease)}
+}
+
+// Lock acquires name for ttl if it is free. Returns the fencing token of the new lease,
+// false if the lock is held.
+func (cache *cache) Lock(name string, ttl time.Duration) (uint64, bool) {
+	locks := cache.locks
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	now := time.Now()
+	if held, ok := locks.leases[name]; ok && held.expiry.After(now) {
+		return 0, false
+	}
+
+	token := cache.nextToken(now)
+	locks.leases[name] = lease{token: token, expiry: now.Add(ttl)}
+	return token, true
+}
+
+// nextToken is the next version, raised to the microseconds since the epoch at now
+// if it is lower. Tokens handed out before a restart stay below the clock after it
+// even when the versions were never backed up, unless the versions outran the clock
+// by being written more than a million times a second.
+func (cache *cache) nextToken(now time.Time) uint64 {
+	floor := uint64(now.UnixMicro())
+	for {
+		version := cache.version.Load()
+		if version >= floor {
+			return cache.nextVersion()
+		}
+		if cache.version.CompareAndSwap(version, floor) {
+			return floor
+		}
+	}
+}
+
+// Renew extends the lease on name held with token to ttl from now.
+// Returns false if the lease was released or expired.
+func (cache *cache) Renew(name string, token uint64, ttl time.Duration) bool {
+	locks := cache.locks
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	now := time.Now()
+	held, ok := locks.leases[name]
+	if !ok || held.token != token || !held.expiry.After(now) {
+		return false
+	}
+
+	locks.leases[name] = lease{token: token, expiry: now.Add(ttl)}
+	return true
+}
+
+// Unlock releases the lease on name held with token.
+// Returns false if the lease was already released or expired.
+func (cache *cache) Unlock(name string, token uint64) bool {
+	locks := cache.locks
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	held, ok := locks.leases[name]
+	if !ok || held.token != token {
+		return false
+	}
+
+	delete(locks.leases, name)
+	return held.expiry.After(time.Now())
+}
+
+// releaseExpired drops every lease past its expiry
+func (locks *lockTable) releaseExpired(now time.Time) {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	for name, held := range locks.leases {
+		if !held.expiry.After(now) {
+			delete(locks.leases, name)
+		}
+	}
+}
+
+// count is the number of leases, including expired ones not released yet
+func (locks *lockTable) count() int {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	return len(locks.leases)
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lockToken(t *testing.T, reply string) uint64 {
+	t.Helper()
+	token, err := strconv.ParseUint(strings.TrimPrefix(reply, "INTEGER "), 10, 64)
+	if err != nil {
+		t.Fatalf("LOCK replied %q", reply)
+	}
+	return token
+}
+
+func TestLockTokensIncreaseAcrossRestarts(t *testing.T) {
+	directory, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(directory)
+
+	for _, backupOn := range []bool{false, true} {
+		var last uint64
+		for restart := range 3 {
+			lebreServer := startTestServer(t, func(serverConfig *ServerConfig) {
+				serverConfig.PoolConfig.BackupOn = backupOn
+			})
+			client := dialTestServer(t, lebreServer)
+
+			// writes push the versions the tokens are drawn from
+			for i := range 100 {
+				client.do("SET", strconv.Itoa(i), "value")
+			}
+			for _, name := range []string{"first", "second"} {
+				token := lockToken(t, client.do("LOCK", name, "60000"))
+				if token <= last {
+					t.Errorf("backups %t, restart %d: token %d after %d", backupOn, restart, token, last)
+				}
+				last = token
+			}
+			lebreServer.Stop()
+		}
+	}
+}
+
+func TestLockTokensStayAboveTheClock(t *testing.T) {
+	cache := newTestCache(nil)
+	now := time.Now()
+
+	first, _ := cache.Lock("first", time.Minute)
+	if first < uint64(now.UnixMicro()) {
+		t.Errorf("token %d is below the clock at %d", first, now.UnixMicro())
+	}
+	cache.Set("key", []byte("value"), 0)
+	second, _ := cache.Lock("second", time.Minute)
+	if second <= first {
+		t.Errorf("token %d after %d", second, first)
+	}
+	if _, version, _, _ := cache.GetWithVersion("key"); version <= first || version >= second {
+		t.Errorf("the key was written with version %d between tokens %d and %d", version, first, second)
+	}
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Messages a subscriber can have waiting to be written before it is disconnected
+	subscriberQueueLength = 1024
+	// Bytes a subscriber can have waiting to be written when the pool configuration leaves it unset
+	defaultSubscriberBufferLimit = 1048576
+)
+
+// pubsub routes published messages to the connections subscribed to a
+// channel, or to a pattern matching it.
+type pubsub struct {
+	mutex    sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+// subscriber is the push side of a connection. Published messages are queued
+// and written by a dedicated goroutine so a slow client never blocks PUBLISH,
+// a client falling too far behind is disconnected instead.
+type subscriber struct {
+	messages chan string
+	// Bytes queued and not yet written
+	pending atomic.Int64
+	limit   int64
+	// Closed when the queue overflows
+	overflow     chan struct{}
+	overflowOnce sync.Once
+	// Only changed by the owning connection, under the pubsub lock
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// Verbs a connection can still send once it is subscribed
+var pushModeVerbs = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func newSubscriber(limit uint32) *subscriber {
+	if limit == 0 {
+		limit = defaultSubscriberBufferLimit
+	}
+	return &subscriber{
+		messages: make(chan string, subscriberQueueLength),
+		limit:    int64(limit),
+		overflow: make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// subscriptions is the number of channels and patterns the subscriber listens to, 0 for nil
+func (subscriber *subscriber) subscriptions() int {
+	if subscriber == nil {
+		return 0
+	}
+	return len(subscriber.channels) + len(subscriber.patterns)
+}
+
+// deliver queues message without blocking. Returns false and flags the
+// subscriber for disconnection if its buffer limits are exceeded.
+func (subscriber *subscriber) deliver(message string) bool {
+	size := int64(len(message))
+	if subscriber.pending.Add(size) > subscriber.limit {
+		subscriber.pending.Add(-size)
+		subscriber.disconnect()
+		return false
+	}
+
+	select {
+	case subscriber.messages <- message:
+		return true
+	default:
+		subscriber.pending.Add(-size)
+		subscriber.disconnect()
+		return false
+	}
+}
+
+func (subscriber *subscriber) disconnect() {
+	subscriber.overflowOnce.Do(func() { close(subscriber.overflow) })
+}
+
+// forward writes queued messages to socket until done is closed.
+// The connection is closed if the subscriber overflows.
+func (subscriber *subscriber) forward(socket *socket, done <-chan struct{}) {
+	for {
+		select {
+		case message := <-subscriber.messages:
+			subscriber.pending.Add(-int64(len(message)))
+			socket.respond(message)
+		case <-subscriber.overflow:
+			socket.logger.ErrLog.Printf("ERR subscriber output buffer limit reached, closing connection\n")
+			socket.conn.Close()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// subscribe adds client to channels, or to patterns if pattern is set.
+// The confirmation with the client's total number of subscriptions is queued
+// under the lock so it always reaches the client before the first message.
+func (pubsub *pubsub) subscribe(client *subscriber, names []string, pattern bool) {
+	pubsub.mutex.Lock()
+	defer pubsub.mutex.Unlock()
+
+	registry, own := pubsub.channels, client.channels
+	if pattern {
+		registry, own = pubsub.patterns, client.patterns
+	}
+
+	for _, name := range names {
+		if registry[name] == nil {
+			registry[name] = make(map[*subscriber]struct{})
+		}
+		registry[name][client] = struct{}{}
+		own[name] = struct{}{}
+	}
+
+	confirmation := "SUBSCRIBED"
+	if pattern {
+		confirmation = "PSUBSCRIBED"
+	}
+	client.deliver(fmt.Sprintf("%s %d", confirmation, client.subscriptions()))
+}
+
+// unsubscribe removes client from channels, or from patterns if pattern is set.
+// No names removes every subscription of that kind.
+// The confirmation with the client's remaining number of subscriptions is queued like for subscribe.
+func (pubsub *pubsub) unsubscribe(client *subscriber, names []string, pattern bool) {
+	pubsub.mutex.Lock()
+	defer pubsub.mutex.Unlock()
+
+	registry, own := pubsub.channels, client.channels
+	if pattern {
+		registry, own = pubsub.patterns, client.patterns
+	}
+
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		delete(own, name)
+		delete(registry[name], client)
+		if len(registry[name]) == 0 {
+			delete(registry, name)
+		}
+	}
+
+	confirmation := "UNSUBSCRIBED"
+	if pattern {
+		confirmation = "PUNSUBSCRIBED"
+	}
+	client.deliver(fmt.Sprintf("%s %d", confirmation, client.subscriptions()))
+}
+
+// Publish sends message to every subscriber of channel and of the patterns
+// matching it. Returns how many subscribers it was queued for.
+func (pubsub *pubsub) Publish(channel, message string) int {
+	pubsub.mutex.RLock()
+	defer pubsub.mutex.RUnlock()
+
+	received := 0
+	if subscribers, ok := pubsub.channels[channel]; ok {
+		push := fmt.Sprintf("MESSAGE %s $%d %s", channel, len(message), message)
+		for subscriber := range subscribers {
+			if subscriber.deliver(push) {
+				received++
+			}
+		}
+	}
+
+	for pattern, subscribers := range pubsub.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		push := fmt.Sprintf("PMESSAGE %s %s $%d %s", pattern, channel, len(message), message)
+		for subscriber := range subscribers {
+			if subscriber.deliver(push) {
+				received++
+			}
+		}
+	}
+	return received
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// queued drains the messages waiting for subscriber
+func queued(subscriber *subscriber) []string {
+	var messages []string
+	for {
+		select {
+		case message := <-subscriber.messages:
+			subscriber.pending.Add(-int64(len(message)))
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	pubsub := newPubsub()
+	news, all := newSubscriber(0), newSubscriber(0)
+	pubsub.subscribe(news, []string{"news", "sport"}, false)
+	pubsub.subscribe(all, []string{"*"}, true)
+	pubsub.subscribe(all, []string{"news"}, false)
+
+	if !slices.Equal(queued(news), []string{"SUBSCRIBED 2"}) || !slices.Equal(queued(all), []string{"PSUBSCRIBED 1", "SUBSCRIBED 2"}) {
+		t.Error("subscriptions weren't confirmed")
+	}
+
+	tests := []struct {
+		channel, message string
+		received         int
+		news, all        []string
+	}{
+		{"news", "hello world", 3, []string{"MESSAGE news $11 hello world"},
+			[]string{"MESSAGE news $11 hello world", "PMESSAGE * news $11 hello world"}},
+		{"weather", "rain", 1, nil, []string{"PMESSAGE * weather $4 rain"}},
+	}
+	for _, test := range tests {
+		if received := pubsub.Publish(test.channel, test.message); received != test.received {
+			t.Errorf("%s: received by %d subscribers", test.channel, received)
+		}
+		if messages := queued(news); !slices.Equal(messages, test.news) {
+			t.Errorf("%s: the channel subscriber got %q", test.channel, messages)
+		}
+		if messages := queued(all); !slices.Equal(messages, test.all) {
+			t.Errorf("%s: the pattern subscriber got %q", test.channel, messages)
+		}
+	}
+
+	pubsub.unsubscribe(news, nil, false)
+	pubsub.unsubscribe(all, []string{"*"}, true)
+	if !slices.Equal(queued(news), []string{"UNSUBSCRIBED 0"}) || !slices.Equal(queued(all), []string{"PUNSUBSCRIBED 1"}) {
+		t.Error("unsubscriptions weren't confirmed")
+	}
+	if received := pubsub.Publish("sport", "goal"); received != 0 || len(pubsub.channels) != 1 || len(pubsub.patterns) != 0 {
+		t.Errorf("unsubscribed channels are still registered: %d received", received)
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	pubsub := newPubsub()
+	slow := newSubscriber(64)
+	pubsub.subscribe(slow, []string{"news"}, false)
+
+	for range 10 {
+		pubsub.Publish("news", "a message of some length")
+	}
+	select {
+	case <-slow.overflow:
+	default:
+		t.Fatal("a subscriber past its buffer limit wasn't disconnected")
+	}
+	if pending := slow.pending.Load(); pending > 64 {
+		t.Errorf("%d bytes are queued for a limit of 64", pending)
+	}
+}
+
+func TestPushMode(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	subscriber := dialTestServer(t, lebreServer)
+	publisher := dialTestServer(t, lebreServer)
+
+	expectReply(t, "SUBSCRIBE", subscriber.do("SUBSCRIBE", "news"), "SUBSCRIBED 1")
+	expectReply(t, "PSUBSCRIBE", subscriber.do("PSUBSCRIBE", "user:*"), "PSUBSCRIBED 2")
+	if reply := subscriber.do("GET", "key"); !strings.HasPrefix(reply, "ERR only SUBSCRIBE") {
+		t.Errorf("GET while subscribed: got %q", reply)
+	}
+
+	expectReply(t, "PUBLISH", publisher.do("PUBLISH", "news", "hello world"), "INTEGER 1")
+	expectReply(t, "PUBLISH", publisher.do("PUBLISH", "user:7", "joined"), "INTEGER 1")
+	expectReply(t, "PUBLISH", publisher.do("PUBLISH", "other", "ignored"), "INTEGER 0")
+	expectReply(t, "message", subscriber.read(), "MESSAGE news $11 hello world")
+	expectReply(t, "message", subscriber.read(), "PMESSAGE user:* user:7 $6 joined")
+
+	expectReply(t, "UNSUBSCRIBE", subscriber.do("UNSUBSCRIBE"), "UNSUBSCRIBED 1")
+	expectReply(t, "PUNSUBSCRIBE", subscriber.do("PUNSUBSCRIBE"), "PUNSUBSCRIBED 0")
+	expectReply(t, "GET", subscriber.do("GET", "key"), "NOT_FOUND")
+}
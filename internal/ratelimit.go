@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var errInvalidWindow = errors.New("invalid window")
+
+// rateLimitResult is the outcome of a RATELIMIT call
+type rateLimitResult struct {
+	allowed   bool
+	remaining int64
+	// Time until the whole limit is available again
+	resetAfter time.Duration
+}
+
+// RateLimit spends cost from the limit allowed per window under key, if enough is left.
+// The sliding window algorithm weighs the previous fixed window by how much of it
+// still overlaps the sliding one, the token bucket one refills limit tokens per window.
+// The state is kept in a node of its own kind under key, expiring once it no longer matters.
+func (cache *cache) RateLimit(key string, limit, cost int64, window time.Duration, bucket bool) (rateLimitResult, error) {
+	// both algorithms divide by the window in milliseconds
+	if window < time.Millisecond {
+		return rateLimitResult{}, errInvalidWindow
+	}
+
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, _, err := shard.lookupKind(key, rateLimitKind, now)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	var state map[string]string
+	var result rateLimitResult
+	var expiry time.Duration
+	if bucket {
+		state, result, expiry = tokenBucket(node.Hash, limit, cost, window, now)
+	} else {
+		state, result, expiry = slidingWindow(node.Hash, limit, cost, window, now)
+	}
+
+	node = cacheNode{Kind: rateLimitKind, Hash: state, Expiry: now.Add(expiry)}
+	node.recount()
+	err = cache.checkDataSize(key, node.dataSize())
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	err = shard.put(key, node)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	return result, nil
+}
+
+func stateInt(state map[string]string, field string) int64 {
+	value, _ := strconv.ParseInt(state[field], 10, 64)
+	return value
+}
+
+// slidingWindow counts the cost spent in the current fixed window and the one before it
+func slidingWindow(state map[string]string, limit, cost int64, window time.Duration, now time.Time) (map[string]string, rateLimitResult, time.Duration) {
+	size := window.Milliseconds()
+	start := now.UnixMilli() / size * size
+	current, previous := stateInt(state, "current"), stateInt(state, "previous")
+
+	switch stateInt(state, "start") {
+	case start:
+	case start - size:
+		previous, current = current, 0
+	default:
+		previous, current = 0, 0
+	}
+
+	elapsed := now.UnixMilli() - start
+	spent := func() int64 {
+		return int64(math.Ceil(float64(previous)*float64(size-elapsed)/float64(size))) + current
+	}
+
+	// cost is at most limit, so the subtraction can't overflow the way a sum could
+	result := rateLimitResult{allowed: spent() <= limit-cost}
+	if result.allowed {
+		current += cost
+	}
+	result.remaining = max(limit-spent(), 0)
+
+	// the current window stops counting once the next one is over, nothing
+	// spent in either means the whole limit is available right away
+	resetAt := now.UnixMilli()
+	if current > 0 {
+		resetAt = start + 2*size
+	} else if previous > 0 {
+		resetAt = start + size
+	}
+	result.resetAfter = time.Duration(resetAt-now.UnixMilli()) * time.Millisecond
+
+	state = map[string]string{
+		"start":    strconv.FormatInt(start, 10),
+		"current":  strconv.FormatInt(current, 10),
+		"previous": strconv.FormatInt(previous, 10),
+	}
+	return state, result, time.Duration(start+2*size-now.UnixMilli()) * time.Millisecond
+}
+
+// tokenBucket holds up to limit tokens, refilled continuously at limit per window
+func tokenBucket(state map[string]string, limit, cost int64, window time.Duration, now time.Time) (map[string]string, rateLimitResult, time.Duration) {
+	rate := float64(limit) / float64(window.Milliseconds())
+
+	tokens := float64(limit)
+	if updated, ok := state["updated"]; ok {
+		last, _ := strconv.ParseInt(updated, 10, 64)
+		previous, _ := strconv.ParseFloat(state["tokens"], 64)
+		tokens = min(float64(limit), previous+float64(max(now.UnixMilli()-last, 0))*rate)
+	}
+
+	result := rateLimitResult{allowed: float64(cost) <= tokens}
+	if result.allowed {
+		tokens -= float64(cost)
+	}
+	result.remaining = int64(math.Floor(tokens))
+	refill := math.Ceil((float64(limit) - tokens) / rate)
+	result.resetAfter = time.Duration(refill) * time.Millisecond
+
+	state = map[string]string{
+		"tokens":  strconv.FormatFloat(tokens, 'f', -1, 64),
+		"updated": strconv.FormatInt(now.UnixMilli(), 10),
+	}
+	// a full bucket reads the same as a missing one
+	return state, result, max(result.resetAfter, time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	window := time.Minute
+	start := time.UnixMilli(window.Milliseconds() * 1000)
+
+	tests := []struct {
+		name       string
+		state      map[string]string
+		cost       int64
+		now        time.Time
+		allowed    bool
+		remaining  int64
+		resetAfter time.Duration
+	}{
+		{"fresh key", nil, 1, start.Add(15 * time.Second), true, 9, 105 * time.Second},
+		{"fresh key spending nothing", nil, 0, start.Add(15 * time.Second), true, 10, 0},
+		{"fresh key over the limit", nil, 11, start.Add(15 * time.Second), false, 10, 0},
+		{"same window", map[string]string{"start": "60000000", "current": "10", "previous": "0"}, 1, start.Add(30 * time.Second), false, 0, 90 * time.Second},
+		{"half of the previous window", map[string]string{"start": "60000000", "current": "10", "previous": "0"}, 1, start.Add(90 * time.Second), true, 4, 90 * time.Second},
+		{"stale state", map[string]string{"start": "60000000", "current": "10", "previous": "10"}, 0, start.Add(5 * time.Minute), true, 10, 0},
+	}
+
+	for _, test := range tests {
+		_, result, _ := slidingWindow(test.state, 10, test.cost, window, test.now)
+		if result.allowed != test.allowed || result.remaining != test.remaining || result.resetAfter != test.resetAfter {
+			t.Errorf("%s: got %+v, expected allowed %t remaining %d reset after %s",
+				test.name, result, test.allowed, test.remaining, test.resetAfter)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.UnixMilli(1000000)
+	state, result, _ := tokenBucket(nil, 10, 10, time.Second, now)
+	if !result.allowed || result.remaining != 0 || result.resetAfter != time.Second {
+		t.Errorf("draining a full bucket: got %+v", result)
+	}
+
+	_, result, _ = tokenBucket(state, 10, 3, time.Second, now.Add(200*time.Millisecond))
+	if result.allowed || result.remaining != 2 {
+		t.Errorf("spending more than refilled: got %+v", result)
+	}
+
+	_, result, _ = tokenBucket(state, 10, 2, time.Second, now.Add(200*time.Millisecond))
+	if !result.allowed || result.remaining != 0 {
+		t.Errorf("spending what was refilled: got %+v", result)
+	}
+}
+
+func TestRateLimitKeepsOtherTypes(t *testing.T) {
+	cache := newTestCache(nil)
+	cache.HashSet("profile", []string{"name"}, []string{"lebre"})
+
+	_, err := cache.RateLimit("profile", 10, 1, time.Minute, false)
+	if !errors.Is(err, errWrongType) {
+		t.Errorf("rate limiting a hash: got %v, expected WRONGTYPE", err)
+	}
+	if items, _ := cache.HashGetAll("profile"); len(items) != 2 {
+		t.Errorf("rate limiting a hash changed it to %q", items)
+	}
+
+	_, err = cache.RateLimit("limiter", 10, 1, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.HashGetAll("limiter"); !errors.Is(err, errWrongType) {
+		t.Errorf("reading a rate limiter as a hash: got %v, expected WRONGTYPE", err)
+	}
+}
+
+func TestRateLimitArguments(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"RATELIMIT", "r", "10", "0"}, "ERR invalid window"},
+		{[]string{"RATELIMIT", "r", "10", "-5"}, "ERR invalid window"},
+		{[]string{"RATELIMIT", "r", "10", "288230376151711744"}, "ERR invalid window"},
+		{[]string{"RATELIMIT", "r", "10", "9223372036854775807", "BUCKET"}, "ERR invalid window"},
+		{[]string{"RATELIMIT", "r", "10", "1000", "9223372036854775807"}, "ERR cost must be a positive integer no larger than the limit"},
+		{[]string{"RATELIMIT", "r", "10", "1000", "11", "BUCKET"}, "ERR cost must be a positive integer no larger than the limit"},
+		{[]string{"RATELIMIT", "r", "10", "1000", "0"}, "ERR cost must be a positive integer no larger than the limit"},
+		{[]string{"RATELIMIT", "r", "10", "1000", "10"}, "VALUES 3 $1 1 $1 0 $"},
+		{[]string{"RATELIMIT", "r", "10", "1000", "1"}, "VALUES 3 $1 0 $1 0 $"},
+	}
+	for _, test := range tests {
+		// the reset time depends on where in the window the call lands, so it isn't compared
+		if reply := client.do(test.args...); !strings.HasPrefix(reply, test.expected) {
+			t.Errorf("%s: got %q, expected %q", strings.Join(test.args, " "), reply, test.expected)
+		}
+	}
+
+	if _, err := newTestCache(nil).RateLimit("r", 10, 1, 0, false); !errors.Is(err, errInvalidWindow) {
+		t.Errorf("rate limiting over an empty window: got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// valuesReply encodes a list of values as "VALUES <count>" followed by one
+// "$<length> <value>" item per value, or "$-1" when the value is missing.
+// Lengths make the encoding unambiguous even for values holding spaces.
+func valuesReply(values []string, found []bool) string {
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "VALUES %d", len(values))
+	writeItems(&reply, values, found)
+	return reply.String()
+}
+
+// writeItems appends " $<length> <value>" for every value, " $-1" for missing
+// ones. A nil found marks every value as present.
+func writeItems(reply *strings.Builder, values []string, found []bool) {
+	for i, value := range values {
+		if found != nil && !found[i] {
+			reply.WriteString(" $-1")
+			continue
+		}
+		fmt.Fprintf(reply, " $%d %s", len(value), value)
+	}
+}
+
+// scanReply encodes a SCAN result as "CURSOR <next> <count>" followed by one
+// "$<length> <key>" item per key.
+func scanReply(cursor uint64, keys []string) string {
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "CURSOR %d %d", cursor, len(keys))
+	writeItems(&reply, keys, nil)
+	return reply.String()
+}
+
+// entriesReply encodes sorted set members as a VALUES reply, each member
+// followed by its score when withScores is set.
+func entriesReply(entries []sortedEntry, withScores bool) string {
+	items := make([]string, 0, len(entries)*2)
+	for _, entry := range entries {
+		items = append(items, entry.Member)
+		if withScores {
+			items = append(items, formatScore(entry.Score))
+		}
+	}
+	return valuesReply(items, nil)
+}
+
+// resultsReply encodes the replies of a transaction as "RESULTS <count>"
+// followed by one "$<length> <reply>" item per queued verb.
+func resultsReply(replies []string) string {
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "RESULTS %d", len(replies))
+	writeItems(&reply, replies, nil)
+	return reply.String()
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"time"
+)
+
+// A SCAN cursor holds the shard index in its top 8 bits and, in the lower 56,
+// the position inside the shard: the smallest key hash not returned yet.
+// Keys are visited in hash order, so a key present for the whole iteration is
+// always returned, no matter how the shard changes between calls.
+const (
+	scanShardShift = 56
+	scanHashMask   = 1<<scanShardShift - 1
+	// Number of keys inspected by a SCAN call without a COUNT
+	defaultScanCount = 10
+)
+
+func scanHash(key string) uint64 {
+	// the low bits of the hash select the shard, the high ones order its keys
+	return hashKey(key) >> (64 - scanShardShift)
+}
+
+// scanIndex orders the keys of a shard by scan hash, then by key, in a
+// skiplist so a SCAN call finds its cursor in O(log n) and only walks the
+// keys it inspects. It is guarded by the shard lock.
+type scanIndex struct {
+	header *scanIndexNode
+	level  int
+}
+
+type scanIndexNode struct {
+	hash    uint64
+	key     string
+	forward []*scanIndexNode
+}
+
+func newScanIndex() *scanIndex {
+	return &scanIndex{
+		header: &scanIndexNode{forward: make([]*scanIndexNode, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+// before reports whether the node sorts before key with hash
+func (node *scanIndexNode) before(hash uint64, key string) bool {
+	return node.hash < hash || (node.hash == hash && node.key < key)
+}
+
+// insert adds key, which must not be in the index already
+func (index *scanIndex) insert(key string) {
+	hash := scanHash(key)
+	var update [skiplistMaxLevel]*scanIndexNode
+
+	node := index.header
+	for i := index.level - 1; i >= 0; i-- {
+		for node.forward[i] != nil && node.forward[i].before(hash, key) {
+			node = node.forward[i]
+		}
+		update[i] = node
+	}
+
+	level := randomLevel()
+	for i := index.level; i < level; i++ {
+		update[i] = index.header
+	}
+	index.level = max(index.level, level)
+
+	inserted := &scanIndexNode{hash: hash, key: key, forward: make([]*scanIndexNode, level)}
+	for i := range inserted.forward {
+		inserted.forward[i] = update[i].forward[i]
+		update[i].forward[i] = inserted
+	}
+}
+
+func (index *scanIndex) remove(key string) {
+	hash := scanHash(key)
+
+	node := index.header
+	for i := index.level - 1; i >= 0; i-- {
+		for node.forward[i] != nil && node.forward[i].before(hash, key) {
+			node = node.forward[i]
+		}
+		if next := node.forward[i]; next != nil && next.key == key {
+			node.forward[i] = next.forward[i]
+		}
+	}
+
+	for index.level > 1 && index.header.forward[index.level-1] == nil {
+		index.level--
+	}
+}
+
+// seek returns the first key whose hash is at least hash, nil past the last one
+func (index *scanIndex) seek(hash uint64) *scanIndexNode {
+	node := index.header
+	for i := index.level - 1; i >= 0; i-- {
+		for node.forward[i] != nil && node.forward[i].hash < hash {
+			node = node.forward[i]
+		}
+	}
+	return node.forward[0]
+}
+
+// Scan inspects up to count keys starting at cursor and returns those matching
+// pattern, along with the cursor to resume from. A returned cursor of zero
+// means the iteration is complete. Only one shard is locked at a time.
+func (cache *cache) Scan(cursor uint64, pattern string, count int) (uint64, []string) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	shardIndex, position := int(cursor>>scanShardShift), cursor&scanHashMask
+	keys := make([]string, 0)
+	inspected := 0
+
+	for shardIndex < len(cache.shards) && inspected < count {
+		live, scanned, next, more := cache.shards[shardIndex].scanFrom(position, count-inspected, time.Now())
+		inspected += scanned
+		for _, key := range live {
+			if pattern == "" || globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+
+		if more {
+			// resume at the first key left uninspected
+			return uint64(shardIndex)<<scanShardShift | next, keys
+		}
+		shardIndex++
+		position = 0
+	}
+
+	if shardIndex >= len(cache.shards) {
+		return 0, keys
+	}
+	return uint64(shardIndex) << scanShardShift, keys
+}
+
+// scanFrom inspects up to limit keys whose hash is at least position, in hash order.
+// Returns the live keys among them and how many were inspected, then the hash
+// of the next key to inspect and true, or false once the shard is done.
+func (shard *cacheShard) scanFrom(position uint64, limit int, now time.Time) ([]string, int, uint64, bool) {
+	shard.Mutex.RLock()
+	defer shard.Mutex.RUnlock()
+
+	live := make([]string, 0, min(limit, len(shard.Data)))
+	inspected := 0
+	node := shard.scanIndex.seek(position)
+	for ; node != nil && inspected < limit; node = node.forward[0] {
+		inspected++
+		if !shard.Data[node.key].expired(now) {
+			live = append(live, node.key)
+		}
+	}
+
+	if node == nil {
+		return live, inspected, 0, false
+	}
+	return live, inspected, node.hash, true
+}
+
+// Size returns the number of keys in the cache, including expired ones not reclaimed yet.
+func (cache *cache) Size() int {
+	size := 0
+	for _, shard := range cache.shards {
+		shard.Mutex.RLock()
+		size += len(shard.Data)
+		shard.Mutex.RUnlock()
+	}
+	return size
+}
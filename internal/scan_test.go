@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScanReturnsEveryKey(t *testing.T) {
+	for _, shards := range []uint16{1, defaultShardCount} {
+		cache := newTestCache(func(config *poolConfig) {
+			config.Shards = shards
+			config.NodeLimit = 10000
+		})
+		for i := range 1000 {
+			cache.Set(fmt.Sprintf("stable:%d", i), []byte("value"), 0)
+		}
+
+		seen := make(map[string]int)
+		cursor, calls := uint64(0), 0
+		for {
+			next, keys := cache.Scan(cursor, "stable:*", 7)
+			if len(keys) > 7 {
+				t.Fatalf("shards=%d: a call with COUNT 7 returned %d keys", shards, len(keys))
+			}
+			for _, key := range keys {
+				seen[key]++
+			}
+
+			// keys coming and going between calls don't hide the stable ones
+			cache.Set(fmt.Sprintf("churn:%d", calls), []byte("value"), 0)
+			cache.Delete(fmt.Sprintf("churn:%d", calls-3))
+
+			calls++
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+
+		if len(seen) != 1000 {
+			t.Errorf("shards=%d: scanned %d of 1000 keys", shards, len(seen))
+		}
+		for key, times := range seen {
+			if times > 1 {
+				t.Errorf("shards=%d: %s returned %d times", shards, key, times)
+			}
+		}
+	}
+}
+
+func TestScanIndex(t *testing.T) {
+	index := newScanIndex()
+	for i := range 200 {
+		index.insert(fmt.Sprint(i))
+	}
+	for i := 0; i < 200; i += 2 {
+		index.remove(fmt.Sprint(i))
+	}
+
+	count := 0
+	var previous uint64
+	for node := index.seek(0); node != nil; node = node.forward[0] {
+		if node.hash < previous {
+			t.Fatalf("%s out of order", node.key)
+		}
+		previous = node.hash
+		count++
+	}
+	if count != 100 {
+		t.Errorf("index holds %d keys, expected 100", count)
+	}
+	if node := index.seek(scanHashMask); node != nil && node.hash != scanHashMask {
+		t.Errorf("seeking past the last key found %s", node.key)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1/2", true},
+		{"user:?", "user:12", false},
+		{"user:[0-9]", "user:7", true},
+		{"user:[^0-9]", "user:7", false},
+		{"user:[abc]*", "user:banana", true},
+		{`user:\*`, "user:*", true},
+		{`user:\*`, "user:1", false},
+		{"*:*:end", "a:b:c:end", true},
+		{"a*b", "acb!", false},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.s); got != test.expected {
+			t.Errorf("%q against %q: got %t", test.pattern, test.s, got)
+		}
+	}
+}
@@ -0,0 +1,813 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Scripts are written in a small Lisp where every expression is either a
+// literal, a variable or a list whose head names a special form or builtin:
+//
+//	(let count (call "INCR" (nth keys 0)))
+//	(if (> count (tonumber (nth args 0)))
+//	    (do (call "DELETE" (nth keys 0)) nil)
+//	    count)
+//
+// Values are nil, true, false, integers, floats, strings and lists. nil and
+// false are falsy, everything else is truthy. The keys and args variables
+// hold the keys and arguments the script was called with.
+
+const (
+	// Evaluation steps a script gets when the pool configuration leaves it unset
+	defaultScriptMaxSteps = 1000000
+	// Deepest expression nesting a script can have
+	scriptMaxDepth = 64
+	// Longest string a script can build
+	scriptMaxStringBytes = 1 << 20
+	// Bytes of string a script builds for each evaluation step they cost
+	scriptStepBytes = 1024
+)
+
+var errScriptSteps = errors.New("script exceeded its step limit")
+
+// scriptSymbol is a variable or form name, as opposed to a string literal
+type scriptSymbol string
+
+// script is a parsed program, shared read only by every run
+type script struct {
+	sha     string
+	program []any
+}
+
+func scriptSHA(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScript reads every top level expression of source
+func parseScript(source string) (*script, error) {
+	parser := &scriptParser{source: source}
+	var program []any
+	for {
+		parser.skipSpace()
+		if parser.position == len(parser.source) {
+			break
+		}
+		expression, err := parser.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		program = append(program, expression)
+	}
+	return &script{sha: scriptSHA(source), program: program}, nil
+}
+
+type scriptParser struct {
+	source   string
+	position int
+}
+
+func (parser *scriptParser) skipSpace() {
+	for parser.position < len(parser.source) {
+		switch parser.source[parser.position] {
+		case ' ', '\t', '\n', '\r':
+			parser.position++
+		case ';':
+			// comments run to the end of the line
+			for parser.position < len(parser.source) && parser.source[parser.position] != '\n' {
+				parser.position++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (parser *scriptParser) expression(depth int) (any, error) {
+	if depth > scriptMaxDepth {
+		return nil, fmt.Errorf("script nested deeper than %d", scriptMaxDepth)
+	}
+
+	parser.skipSpace()
+	if parser.position == len(parser.source) {
+		return nil, fmt.Errorf("unexpected end of script")
+	}
+
+	switch parser.source[parser.position] {
+	case '(':
+		parser.position++
+		list := []any{}
+		for {
+			parser.skipSpace()
+			if parser.position == len(parser.source) {
+				return nil, fmt.Errorf("missing ')'")
+			}
+			if parser.source[parser.position] == ')' {
+				parser.position++
+				return list, nil
+			}
+			element, err := parser.expression(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, element)
+		}
+	case ')':
+		return nil, fmt.Errorf("unexpected ')' at %d", parser.position)
+	case '"':
+		return parser.stringLiteral()
+	default:
+		return parser.atom(), nil
+	}
+}
+
+func (parser *scriptParser) stringLiteral() (string, error) {
+	var text strings.Builder
+	for parser.position++; parser.position < len(parser.source); parser.position++ {
+		char := parser.source[parser.position]
+		switch char {
+		case '"':
+			parser.position++
+			return text.String(), nil
+		case '\\':
+			parser.position++
+			if parser.position == len(parser.source) {
+				break
+			}
+			switch parser.source[parser.position] {
+			case 'n':
+				text.WriteByte('\n')
+			case 't':
+				text.WriteByte('\t')
+			default:
+				text.WriteByte(parser.source[parser.position])
+			}
+		default:
+			text.WriteByte(char)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (parser *scriptParser) atom() any {
+	start := parser.position
+	for parser.position < len(parser.source) {
+		char := parser.source[parser.position]
+		if char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '(' || char == ')' || char == ';' {
+			break
+		}
+		parser.position++
+	}
+
+	text := parser.source[start:parser.position]
+	if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return integer
+	}
+	if float, err := strconv.ParseFloat(text, 64); err == nil && strings.ContainsAny(text, "0123456789") {
+		return float
+	}
+	return scriptSymbol(text)
+}
+
+// interpreter runs one script. call executes a verb against the cache and
+// returns its decoded reply.
+type interpreter struct {
+	steps    int
+	maxSteps int
+	vars     map[string]any
+	call     func(requestParts []string) (any, error)
+}
+
+func newInterpreter(maxSteps uint32, keys, args []string, call func([]string) (any, error)) *interpreter {
+	if maxSteps == 0 {
+		maxSteps = defaultScriptMaxSteps
+	}
+	return &interpreter{
+		maxSteps: int(maxSteps),
+		vars: map[string]any{
+			"keys": stringList(keys),
+			"args": stringList(args),
+		},
+		call: call,
+	}
+}
+
+func stringList(values []string) []any {
+	list := make([]any, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
+
+// run evaluates every expression of script, returning the value of the last one
+func (interpreter *interpreter) run(script *script) (any, error) {
+	var result any
+	for _, expression := range script.program {
+		value, err := interpreter.eval(expression)
+		if err != nil {
+			return nil, err
+		}
+		result = value
+	}
+	return result, nil
+}
+
+func truthy(value any) bool {
+	return value != nil && value != false
+}
+
+// charge counts steps taken by the work of a single expression, like the
+// elements of a list it builds
+func (interpreter *interpreter) charge(steps int) error {
+	interpreter.steps += steps
+	if interpreter.steps > interpreter.maxSteps {
+		return errScriptSteps
+	}
+	return nil
+}
+
+func (interpreter *interpreter) eval(expression any) (any, error) {
+	err := interpreter.charge(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expression := expression.(type) {
+	case scriptSymbol:
+		switch expression {
+		case "nil":
+			return nil, nil
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		value, ok := interpreter.vars[string(expression)]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable '%s'", expression)
+		}
+		return value, nil
+	case []any:
+		return interpreter.apply(expression)
+	default:
+		return expression, nil
+	}
+}
+
+func (interpreter *interpreter) apply(list []any) (any, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	name, ok := list[0].(scriptSymbol)
+	if !ok {
+		return nil, fmt.Errorf("expression must start with a name")
+	}
+	operands := list[1:]
+
+	switch name {
+	case "do":
+		var result any
+		for _, operand := range operands {
+			value, err := interpreter.eval(operand)
+			if err != nil {
+				return nil, err
+			}
+			result = value
+		}
+		return result, nil
+
+	case "let":
+		variable, ok := scriptOperand(operands, 0).(scriptSymbol)
+		if !ok || len(operands) != 2 {
+			return nil, fmt.Errorf("let takes a name and a value")
+		}
+		value, err := interpreter.eval(operands[1])
+		if err != nil {
+			return nil, err
+		}
+		interpreter.vars[string(variable)] = value
+		return value, nil
+
+	case "if":
+		if len(operands) < 2 || len(operands) > 3 {
+			return nil, fmt.Errorf("if takes a condition, a then and an optional else")
+		}
+		condition, err := interpreter.eval(operands[0])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(condition) {
+			return interpreter.eval(operands[1])
+		}
+		if len(operands) == 3 {
+			return interpreter.eval(operands[2])
+		}
+		return nil, nil
+
+	case "while":
+		if len(operands) < 1 {
+			return nil, fmt.Errorf("while takes a condition")
+		}
+		for {
+			condition, err := interpreter.eval(operands[0])
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(condition) {
+				return nil, nil
+			}
+			for _, operand := range operands[1:] {
+				_, err := interpreter.eval(operand)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+	case "and", "or":
+		var value any = name == "and"
+		for _, operand := range operands {
+			var err error
+			value, err = interpreter.eval(operand)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(value) != (name == "and") {
+				return value, nil
+			}
+		}
+		return value, nil
+	}
+
+	values := make([]any, len(operands))
+	for i, operand := range operands {
+		value, err := interpreter.eval(operand)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return interpreter.builtin(string(name), values)
+}
+
+func scriptOperand(operands []any, index int) any {
+	if index < len(operands) {
+		return operands[index]
+	}
+	return nil
+}
+
+func (interpreter *interpreter) builtin(name string, values []any) (any, error) {
+	switch name {
+	case "+", "-", "*", "/", "%":
+		return arithmetic(name, values)
+
+	case "=", "!=":
+		if len(values) != 2 {
+			return nil, fmt.Errorf("%s takes 2 values", name)
+		}
+		equal, err := scriptEqual(values[0], values[1])
+		return equal == (name == "="), err
+
+	case "<", "<=", ">", ">=":
+		if len(values) != 2 {
+			return nil, fmt.Errorf("%s takes 2 values", name)
+		}
+		return compare(name, values[0], values[1])
+
+	case "not":
+		if len(values) != 1 {
+			return nil, fmt.Errorf("not takes 1 value")
+		}
+		return !truthy(values[0]), nil
+
+	case "concat":
+		length := 0
+		for _, value := range values {
+			if _, ok := value.([]any); ok {
+				return nil, fmt.Errorf("lists can't be converted to strings")
+			}
+			if text, ok := value.(string); ok {
+				length += len(text)
+			}
+		}
+		if length > scriptMaxStringBytes {
+			return nil, fmt.Errorf("string longer than %d bytes", scriptMaxStringBytes)
+		}
+		err := interpreter.charge(len(values) + length/scriptStepBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		var text strings.Builder
+		for _, value := range values {
+			text.WriteString(scriptString(value))
+		}
+		return text.String(), nil
+
+	case "tostring":
+		if len(values) != 1 {
+			return nil, fmt.Errorf("tostring takes 1 value")
+		}
+		if _, ok := values[0].([]any); ok {
+			return nil, fmt.Errorf("lists can't be converted to strings")
+		}
+		return scriptString(values[0]), nil
+
+	case "tonumber":
+		if len(values) != 1 {
+			return nil, fmt.Errorf("tonumber takes 1 value")
+		}
+		return scriptNumber(values[0]), nil
+
+	case "len":
+		if len(values) != 1 {
+			return nil, fmt.Errorf("len takes 1 value")
+		}
+		switch value := values[0].(type) {
+		case string:
+			return int64(len(value)), nil
+		case []any:
+			return int64(len(value)), nil
+		case nil:
+			return int64(0), nil
+		}
+		return nil, fmt.Errorf("len of a %s", scriptType(values[0]))
+
+	case "list":
+		// lists hold lists of scalars at most, walking them stays cheap
+		elements := len(values)
+		for _, value := range values {
+			if list, ok := value.([]any); ok {
+				for _, element := range list {
+					if _, ok := element.([]any); ok {
+						return nil, fmt.Errorf("lists can't be nested more than 2 deep")
+					}
+				}
+				elements += len(list)
+			}
+		}
+		err := interpreter.charge(elements)
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+
+	case "nth":
+		list, ok := scriptOperand(values, 0).([]any)
+		index, isInteger := scriptOperand(values, 1).(int64)
+		if !ok || !isInteger || len(values) != 2 {
+			return nil, fmt.Errorf("nth takes a list and an integer")
+		}
+		if index < 0 || index >= int64(len(list)) {
+			return nil, nil
+		}
+		return list[index], nil
+
+	case "error":
+		if _, ok := scriptOperand(values, 0).([]any); ok {
+			return nil, fmt.Errorf("lists can't be converted to strings")
+		}
+		return nil, fmt.Errorf("%s", scriptString(scriptOperand(values, 0)))
+
+	case "call":
+		if len(values) == 0 {
+			return nil, fmt.Errorf("call takes a verb")
+		}
+		requestParts := make([]string, 0, len(values)+1)
+		// arguments are passed verbatim, whitespace and all
+		requestParts = append(requestParts, protocolV2)
+		for _, value := range values {
+			if _, ok := value.([]any); ok {
+				return nil, fmt.Errorf("call arguments can't be lists")
+			}
+			requestParts = append(requestParts, scriptString(value))
+		}
+		result, err := interpreter.call(requestParts)
+		if err != nil {
+			return nil, err
+		}
+		// decoding the elements of a reply costs like building them
+		if list, ok := result.([]any); ok {
+			err = interpreter.charge(len(list))
+		}
+		return result, err
+	}
+
+	return nil, fmt.Errorf("unknown function '%s'", name)
+}
+
+func scriptType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	default:
+		return "list"
+	}
+}
+
+func scriptString(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		// callers reject lists before converting
+		return ""
+	}
+}
+
+// scriptNumber converts a value to a number, nil if it isn't one
+func scriptNumber(value any) any {
+	switch value := value.(type) {
+	case int64, float64:
+		return value
+	case string:
+		if integer, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return integer
+		}
+		if float, err := strconv.ParseFloat(value, 64); err == nil {
+			return float
+		}
+	}
+	return nil
+}
+
+func toFloat(value any) (float64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+func arithmetic(operator string, values []any) (any, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s takes at least 1 value", operator)
+	}
+	if operator == "-" && len(values) == 1 {
+		values = []any{int64(0), values[0]}
+	}
+
+	result := values[0]
+	for _, value := range values[1:] {
+		left, leftInteger := result.(int64)
+		right, rightInteger := value.(int64)
+		if leftInteger && rightInteger {
+			switch operator {
+			case "+":
+				result = left + right
+			case "-":
+				result = left - right
+			case "*":
+				result = left * right
+			case "/", "%":
+				if right == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if operator == "/" {
+					result = left / right
+				} else {
+					result = left % right
+				}
+			}
+			continue
+		}
+
+		leftFloat, leftNumber := toFloat(result)
+		rightFloat, rightNumber := toFloat(value)
+		if !leftNumber || !rightNumber {
+			return nil, fmt.Errorf("%s on a %s and a %s", operator, scriptType(result), scriptType(value))
+		}
+		switch operator {
+		case "+":
+			result = leftFloat + rightFloat
+		case "-":
+			result = leftFloat - rightFloat
+		case "*":
+			result = leftFloat * rightFloat
+		case "/":
+			result = leftFloat / rightFloat
+		case "%":
+			return nil, fmt.Errorf("%% takes integers")
+		}
+	}
+
+	if _, ok := toFloat(result); !ok {
+		return nil, fmt.Errorf("%s on a %s", operator, scriptType(result))
+	}
+	return result, nil
+}
+
+func scriptEqual(left, right any) (bool, error) {
+	leftFloat, leftNumber := toFloat(left)
+	rightFloat, rightNumber := toFloat(right)
+	if leftNumber && rightNumber {
+		return leftFloat == rightFloat, nil
+	}
+	_, leftList := left.([]any)
+	_, rightList := right.([]any)
+	if leftList || rightList {
+		return false, fmt.Errorf("lists can't be compared")
+	}
+	return left == right, nil
+}
+
+func compare(operator string, left, right any) (bool, error) {
+	var order int
+	leftFloat, leftNumber := toFloat(left)
+	rightFloat, rightNumber := toFloat(right)
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+
+	switch {
+	case leftNumber && rightNumber:
+		if leftFloat < rightFloat {
+			order = -1
+		} else if leftFloat > rightFloat {
+			order = 1
+		}
+	case leftIsString && rightIsString:
+		order = strings.Compare(leftString, rightString)
+	default:
+		return false, fmt.Errorf("%s on a %s and a %s", operator, scriptType(left), scriptType(right))
+	}
+
+	switch operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	default:
+		return order >= 0, nil
+	}
+}
+
+// Verbs a script can't call
+var nonScriptVerbs = map[string]bool{
+	"EVAL":    true,
+	"EVALSHA": true,
+	"SCRIPT":  true,
+}
+
+// evalScript runs script for session with the transaction gate held for
+// writing by the caller, so the whole script is atomic.
+func (lebreServer *LebreServer) evalScript(session *session, script *script, keys, args []string) string {
+	call := func(requestParts []string) (any, error) {
+		verb := requestParts[1]
+		if nonScriptVerbs[verb] || nonTransactionalVerbs[verb] {
+			return nil, fmt.Errorf("%s can't be called from a script", verb)
+		}
+		return decodeReply(lebreServer.execute(session, requestParts))
+	}
+
+	interpreter := newInterpreter(lebreServer.ServerConfig.PoolConfig.ScriptMaxSteps, keys, args, call)
+	result, err := interpreter.run(script)
+	if err != nil {
+		return fmt.Sprintf("ERR script %s: %s", script.sha, err)
+	}
+
+	reply, err := encodeScriptValue(result)
+	if err != nil {
+		return fmt.Sprintf("ERR script %s: %s", script.sha, err)
+	}
+	return reply
+}
+
+// decodeReply turns the reply of a verb into a script value, replies
+// signalling an error make the script fail.
+func decodeReply(reply string) (any, error) {
+	verb, rest, _ := strings.Cut(reply, " ")
+	switch verb {
+	case "ERR":
+		return nil, errors.New(rest)
+	case "NOT_FOUND", "NOT_STORED":
+		return nil, nil
+	case "VALUE":
+		return rest, nil
+	case "INTEGER":
+		return strconv.ParseInt(rest, 10, 64)
+	case "VALUES":
+		count, items, _ := strings.Cut(rest, " ")
+		return decodeItems(count, items)
+	case "CURSOR":
+		// a cursor followed by the keys
+		cursor, rest, _ := strings.Cut(rest, " ")
+		count, items, _ := strings.Cut(rest, " ")
+		keys, err := decodeItems(count, items)
+		if err != nil {
+			return nil, err
+		}
+		return []any{cursor, keys}, nil
+	default:
+		return reply, nil
+	}
+}
+
+// decodeItems reads count "$<length> <value>" items as written by writeItems
+func decodeItems(count, items string) ([]any, error) {
+	total, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("malformed reply")
+	}
+
+	values := make([]any, 0, total)
+	for i := 0; i < total; i++ {
+		header, rest, _ := strings.Cut(strings.TrimPrefix(items, " "), " ")
+		length, err := strconv.Atoi(strings.TrimPrefix(header, "$"))
+		if err != nil || !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("malformed reply")
+		}
+		if length < 0 {
+			values = append(values, nil)
+			items = " " + rest
+			continue
+		}
+		if length > len(rest) {
+			return nil, fmt.Errorf("malformed reply")
+		}
+		values = append(values, rest[:length])
+		items = rest[length:]
+	}
+	return values, nil
+}
+
+// encodeScriptValue turns the result of a script into a reply. Lists can
+// only hold scalars, false reads like nil.
+func encodeScriptValue(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "NOT_FOUND", nil
+	case bool:
+		if value {
+			return "INTEGER 1", nil
+		}
+		return "NOT_FOUND", nil
+	case int64:
+		return fmt.Sprintf("INTEGER %d", value), nil
+	case []any:
+		items := make([]string, len(value))
+		found := make([]bool, len(value))
+		for i, element := range value {
+			switch element.(type) {
+			case []any:
+				return "", fmt.Errorf("can't return nested lists")
+			case nil:
+			default:
+				items[i], found[i] = scriptString(element), true
+			}
+		}
+		return valuesReply(items, found), nil
+	default:
+		return fmt.Sprintf("VALUE %s", scriptString(value)), nil
+	}
+}
+
+// scriptArguments splits "numkeys key [key ...] arg [arg ...]" into keys and args
+func scriptArguments(parts []string) ([]string, []string, error) {
+	if len(parts) == 0 {
+		return nil, nil, fmt.Errorf("wrong number of arguments")
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count < 0 || count > len(parts)-1 {
+		return nil, nil, fmt.Errorf("number of keys is invalid")
+	}
+	return parts[1 : count+1], parts[count+1:], nil
+}
+
+// loadScript parses source and caches it for EVALSHA
+func (lebreServer *LebreServer) loadScript(source string) (*script, error) {
+	sha := scriptSHA(source)
+	if cached, ok := lebreServer.scripts.Load(sha); ok {
+		return cached.(*script), nil
+	}
+
+	script, err := parseScript(source)
+	if err != nil {
+		return nil, err
+	}
+	lebreServer.scripts.Store(sha, script)
+	return script, nil
+}
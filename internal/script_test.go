@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func runScript(t *testing.T, source string, maxSteps uint32) (any, error) {
+	t.Helper()
+	script, err := parseScript(source)
+	if err != nil {
+		t.Fatalf("%s: %s", source, err)
+	}
+	call := func(requestParts []string) (any, error) {
+		return stringList(requestParts[1:]), nil
+	}
+	return newInterpreter(maxSteps, []string{"key"}, []string{"7"}, call).run(script)
+}
+
+func TestScriptValues(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected any
+	}{
+		{`(+ 1 2 3)`, int64(6)},
+		{`(/ 7 2)`, int64(3)},
+		{`(* 1.5 2)`, 3.0},
+		{`(- 5)`, int64(-5)},
+		{`(concat "a" 1 2.5 nil true)`, "a12.5true"},
+		{`(tonumber (nth args 0))`, int64(7)},
+		{`(nth keys 3)`, nil},
+		{`(len (list 1 2 3))`, int64(3)},
+		{`(if (< "a" "b") "yes" "no")`, "yes"},
+		{`(and 1 nil 2)`, nil},
+		{`(or nil false 3)`, int64(3)},
+		{`(let i 0) (let total 0) (while (< i 4) (let total (+ total i)) (let i (+ i 1))) total`, int64(6)},
+		{`(call "HSET" "a b" 1)`, []any{"HSET", "a b", "1"}},
+		{`(list 1 (list 2 3))`, []any{int64(1), []any{int64(2), int64(3)}}},
+	}
+
+	for _, test := range tests {
+		result, err := runScript(t, test.source, 0)
+		if err != nil {
+			t.Errorf("%s: %s", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.source, result, test.expected)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	sources := []string{
+		`(/ 1 0)`,
+		`(+ 1 "a")`,
+		`(undefined 1)`,
+		`missing`,
+		`(tostring (list 1))`,
+		`(concat "a" (list 1))`,
+		`(list (list (list 1)))`,
+		`(let x (list 1)) (while true (let x (list x x)))`,
+		`(call "SET" (list 1) 2)`,
+		`(= (list 1) (list 1))`,
+		`(error "failed")`,
+	}
+
+	for _, source := range sources {
+		if _, err := runScript(t, source, 0); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestScriptStepLimit(t *testing.T) {
+	sources := []string{
+		`(while true)`,
+		// strings and lists cost steps for every byte or element they are built from
+		`(let x "") (while true (let x (concat x "0123456789")))`,
+		`(let x (call "MGET" 1 2 3 4 5 6 7 8 9)) (while true (let y (list x x x x x x x x)))`,
+	}
+
+	for _, source := range sources {
+		start := time.Now()
+		_, err := runScript(t, source, 2000)
+		if !errors.Is(err, errScriptSteps) {
+			t.Errorf("%s: got %v, expected the step limit", source, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %s to hit the step limit", source, elapsed)
+		}
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	sources := []string{`(+ 1 2`, `)`, `"unterminated`, `(1 2)`}
+	for _, source := range sources {
+		script, err := parseScript(source)
+		if err == nil {
+			_, err = newInterpreter(0, nil, nil, nil).run(script)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+	script := `(let n (call "INCR" (nth keys 0))) (if (> n (tonumber (nth args 0))) false n)`
+
+	expectReply(t, "EVAL", client.do("EVAL", script, "1", "hits", "2"), "INTEGER 1")
+	expectReply(t, "EVAL", client.do("EVAL", script, "1", "hits", "2"), "INTEGER 2")
+	expectReply(t, "EVALSHA", client.do("EVALSHA", scriptSHA(script), "1", "hits", "2"), "NOT_FOUND")
+	expectReply(t, "EVAL", client.do("EVAL", `(call "HSET")`, "0"),
+		"ERR script "+scriptSHA(`(call "HSET")`)+": wrong number of arguments for HSET")
+	expectReply(t, "EVAL", client.do("EVAL", `(call "BLPOP" "list" 0)`, "0"),
+		"ERR script "+scriptSHA(`(call "BLPOP" "list" 0)`)+": BLPOP can't be called from a script")
+}
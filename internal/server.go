@@ -3,16 +3,22 @@ package internal
 import (
 	"bufio"
 	"bytes"
-	"crypto/rsa"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,7 +31,7 @@ type poolConfig struct {
 	BackupOn bool `json:"backUpOn"`
 	// Backup cycle in milliseconds
 	BackupCycle uint32 `json:"backUpCycle"`
-	// Lifetime of a single cache node in milliseconds
+	// Default lifetime of a single cache node in seconds, 0 disables expiry
 	TimeToLive uint16 `json:"timeToLive"`
 	// Maximum number of simultaneous cache nodes
 	NodeLimit uint32 `json:"nodeLimit"`
@@ -33,6 +39,18 @@ type poolConfig struct {
 	NodeSize uint16 `json:"nodeSize"`
 	// cache size maximum limit in bytes
 	CacheLimit uint32 `json:"cacheLimit"`
+	// Key eviction policy once a limit is reached: allkeys-lru (default), allkeys-lfu,
+	// allkeys-fifo, allkeys-random, their volatile-* variants that only evict keys
+	// with an expiry, or noeviction to fail writes instead
+	EvictionPolicy string `json:"evictionPolicy"`
+	// Number of independently locked cache shards, rounded down to a power of two (DEFAULT 16)
+	Shards uint16 `json:"shards"`
+	// Bytes of published messages a subscriber can fall behind before it is disconnected (DEFAULT 1MB)
+	SubscriberBufferLimit uint32 `json:"subscriberBufferLimit"`
+	// Keyspace events published to subscribers: set, del, expired, evicted or all (DEFAULT none)
+	KeyspaceEvents []string `json:"keyspaceEvents"`
+	// Evaluation steps a script can take before it is aborted (DEFAULT 1000000)
+	ScriptMaxSteps uint32 `json:"scriptMaxSteps"`
 }
 
 type ServerConfig struct {
@@ -42,50 +60,209 @@ type ServerConfig struct {
 	Port             uint32      `json:"port"`
 	EnableEncryption bool        `json:"enableEncryption"`
 	PoolConfig       *poolConfig `json:"poolConfig"`
+	// Accept unencrypted connections on every interface instead of loopback only
+	AllowRemotePlaintext bool `json:"allowRemotePlaintext"`
+	// Serves over TLS instead of the built in key exchange when set
+	TLS *tlsConfig `json:"tls,omitempty"`
+	// PEM file of the key signing the key exchange, created by lebre init or the first start (DEFAULT identity.key)
+	IdentityKeyFile string `json:"identityKeyFile"`
 }
 
+const defaultIdentityKeyFile = "identity.key"
+
+// IdentityKeyPath is the identity key file, configurations written before it existed use the default
+func (serverConfig *ServerConfig) IdentityKeyPath() string {
+	if serverConfig.IdentityKeyFile == "" {
+		return defaultIdentityKeyFile
+	}
+	return serverConfig.IdentityKeyFile
+}
+
+// Version of binary requests made of length prefixed arguments, any other
+// version is a V1 text request
+const protocolV2 = "V2.0"
+
 type credentials struct {
 	User     string
 	Password string
 }
 
 type socket struct {
-	serverPublicKey  *rsa.PublicKey
-	serverPrivateKey *rsa.PrivateKey
-	logger           *Cli
-	conn             net.Conn
+	// Seal the frames sent to the client and open the ones it sends, set by
+	// negotiate. Both stay nil over TLS, which already encrypts the stream, and
+	// when encryption is disabled.
+	sendCipher    *frameCipher
+	receiveCipher *frameCipher
+	logger        *Cli
+	conn          net.Conn
+	reader        *bufio.Reader
+	// Serializes responses with the messages pushed to subscribers
+	mutex sync.Mutex
+	// Deadline given to every write
+	writeTimeout time.Duration
+}
+
+// session is the state a connection keeps between requests
+type session struct {
+	socket     *socket
+	logger     *Cli
+	authorized bool
+	// Set once the connection subscribes, its messages are pushed until the connection ends
+	subscriber *subscriber
+	// Closed when the connection ends
+	closed chan struct{}
+	// Open MULTI block, nil outside of one
+	transaction *transaction
+	// Versions of the keys watched for the next EXEC, as returned by cache.Versions
+	watched map[string]uint64
+	// Tokens of the locks taken with SESSION, released when the connection ends
+	locks map[string]uint64
 }
 
 type LebreServer struct {
 	ServerConfig ServerConfig
 	credentials  *credentials
-	cache        cache
+	cache        *cache
+	pubsub       *pubsub
+	// Parsed scripts by SHA1, filled by EVAL and SCRIPT LOAD
+	scripts sync.Map
+	// Signs the key exchange of every connection, nil over TLS
+	identityKey ed25519.PrivateKey
+	listener    net.Listener
+	// Closed on Stop to end the background maintenance loops
+	done chan struct{}
+	// Guards listener and done against Stop running before or during Start
+	lifecycle sync.Mutex
+	stopped   bool
+	// Keeps the periodic backup and the one taken on Stop from writing the file at once
+	backups sync.Mutex
 }
 
 func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
 		Port:             5051,
 		EnableEncryption: true,
+		IdentityKeyFile:  defaultIdentityKeyFile,
 		PoolConfig: &poolConfig{
-			MaxConns:          15,
-			ConnectionTimeout: 30000,
-			BackupCycle:       300000,
-			TimeToLive:        300,
-			NodeLimit:         3500,
-			NodeSize:          1024,
-			CacheLimit:        5242880,
+			MaxConns:              15,
+			ConnectionTimeout:     30000,
+			BackupCycle:           300000,
+			TimeToLive:            300,
+			NodeLimit:             3500,
+			NodeSize:              1024,
+			CacheLimit:            5242880,
+			EvictionPolicy:        "allkeys-lru",
+			Shards:                defaultShardCount,
+			SubscriberBufferLimit: defaultSubscriberBufferLimit,
+			ScriptMaxSteps:        defaultScriptMaxSteps,
 		},
 	}
 }
 
 func (socket *socket) getRequestParts(data []byte) ([]string, error) {
-	decryptedData, err := RSADecrypt(data, socket.serverPrivateKey)
+	if socket.receiveCipher == nil {
+		return parseRequest(data)
+	}
+
+	decryptedData, err := socket.receiveCipher.open(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return strings.Fields(string(decryptedData)), nil
+	return parseRequest(decryptedData)
+}
+
+// parseRequest splits a request into its version, verb and arguments.
+// V2 requests are the version followed by arguments prefixed by their length
+// in a 32-bit Big Endian integer, anything else is a V1 request split on whitespace.
+func parseRequest(data []byte) ([]string, error) {
+	if !bytes.HasPrefix(data, []byte(protocolV2)) {
+		return strings.Fields(string(data)), nil
+	}
 
+	requestParts := []string{protocolV2}
+	for arguments := data[len(protocolV2):]; len(arguments) > 0; {
+		if len(arguments) < 4 {
+			return nil, errors.New("truncated argument length in V2 request")
+		}
+		length := binary.BigEndian.Uint32(arguments)
+		arguments = arguments[4:]
+		if uint64(length) > uint64(len(arguments)) {
+			return nil, errors.New("argument longer than the V2 request")
+		}
+		requestParts = append(requestParts, string(arguments[:length]))
+		arguments = arguments[length:]
+	}
+	return requestParts, nil
+}
+
+// requestValue returns a value argument of a request. V1 requests can't hold
+// whitespace so values escape spaces as \u0020, V2 arguments are taken as sent.
+func requestValue(requestParts []string, value string) string {
+	if requestParts[0] == protocolV2 {
+		return value
+	}
+	return strings.ReplaceAll(value, "\\u0020", "\u0020")
+}
+
+// redactRequest joins the request parts for logging, replacing the value at index with its hash
+func redactRequest(requestParts []string, index int) string {
+	redacted := make([]string, len(requestParts))
+	copy(redacted, requestParts)
+	if index < len(redacted) {
+		redacted[index] = fmt.Sprintf("%x", sha256.Sum256([]byte(redacted[index])))
+	}
+	return strings.Join(redacted, " ")
+}
+
+// parseTimeToLive converts an EX (seconds) or PX (milliseconds) option into a duration
+func parseTimeToLive(unit, amount string) (time.Duration, error) {
+	var scale time.Duration
+	switch strings.ToUpper(unit) {
+	case "EX":
+		scale = time.Second
+	case "PX":
+		scale = time.Millisecond
+	default:
+		return 0, fmt.Errorf("syntax error near '%s'", unit)
+	}
+
+	// amounts past what a duration holds would wrap around to a negative or a short one
+	value, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || value <= 0 || value > math.MaxInt64/int64(scale) {
+		return 0, fmt.Errorf("invalid expire time '%s'", amount)
+	}
+	return time.Duration(value) * scale, nil
+}
+
+// parseSetOptions reads the optional SET arguments: EX seconds, PX milliseconds, NX and XX
+func parseSetOptions(args []string) (setOptions, error) {
+	var options setOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			options.onlyIfMissing = true
+		case "XX":
+			options.onlyIfExists = true
+		case "EX", "PX":
+			if i+1 == len(args) || options.ttl != 0 {
+				return options, fmt.Errorf("syntax error near '%s'", args[i])
+			}
+			ttl, err := parseTimeToLive(args[i], args[i+1])
+			if err != nil {
+				return options, err
+			}
+			options.ttl = ttl
+			i++
+		default:
+			return options, fmt.Errorf("syntax error near '%s'", args[i])
+		}
+	}
+
+	if options.onlyIfMissing && options.onlyIfExists {
+		return options, fmt.Errorf("NX and XX options at the same time are not compatible")
+	}
+	return options, nil
 }
 
 func (socket *socket) sendMessage(data []byte) error {
@@ -112,69 +289,120 @@ func (socket *socket) sendMessage(data []byte) error {
 	return nil
 }
 
-func (socket *socket) respond(data string) {
-	encryptedResponse, err := RSAEncrypt([]byte(data), socket.serverPublicKey)
+// receiveMessage reads a single length prefixed frame
+func (socket *socket) receiveMessage() ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(socket.reader, lengthBytes)
 	if err != nil {
-		socket.logger.ErrLog.Println(fmt.Sprintf("Error encrypting response: %s\n", err))
-		return
+		return nil, fmt.Errorf("failed to read message length: %s", err)
 	}
 
-	err = socket.sendMessage(encryptedResponse)
+	// retrieve first 32 bits containing the message length integer
+	messageLength := binary.BigEndian.Uint32(lengthBytes)
+	messageBytes := make([]byte, messageLength)
+	_, err = io.ReadFull(socket.reader, messageBytes)
 	if err != nil {
-		socket.logger.ErrLog.Println(fmt.Sprintf("Error while sending response: %s\n", err))
-		return
+		return nil, fmt.Errorf("failed to read message: %s", err)
+	}
+	return messageBytes, nil
+}
+
+// watchDisconnect returns a channel closed if the client disconnects before
+// stop is called, for requests that wait without reading. Requests sent in the
+// meantime are left buffered for the next read, a client filling the buffer is
+// treated as gone. Nothing else may read from the connection until stop returns.
+func (socket *socket) watchDisconnect() (<-chan struct{}, func()) {
+	disconnected := make(chan struct{})
+	watching := make(chan struct{})
+
+	socket.conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(watching)
+		for {
+			_, err := socket.reader.Peek(socket.reader.Buffered() + 1)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				close(disconnected)
+			}
+			return
+		}
+	}()
+
+	return disconnected, func() {
+		// unblocks the peek, the next read sets its own deadline
+		socket.conn.SetReadDeadline(time.Now())
+		<-watching
 	}
 }
 
-func (socket *socket) negotiate() error {
-	// receive server public key
-	readerBuffer := make([]byte, 1024)
-	_, err := socket.conn.Read(readerBuffer)
+func (socket *socket) respond(data string) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	socket.conn.SetWriteDeadline(time.Now().Add(socket.writeTimeout))
+	message := []byte(data)
+	if socket.sendCipher != nil {
+		message = socket.sendCipher.seal(message)
+	}
+	err := socket.sendMessage(message)
 	if err != nil {
-		socket.logger.ErrLog.Printf("ERR couldn't read server public key from connection: %s\n", err)
-		return err
+		socket.logger.ErrLog.Println(fmt.Sprintf("Error while sending response: %s\n", err))
+		return
 	}
+}
 
-	var serverPublicKey *rsa.PublicKey
-	serverPublicKey, err = PEMToPublicKey(strings.TrimSpace(string(readerBuffer)))
+// negotiate runs the key exchange: the client sends its ephemeral X25519 public
+// key, the server answers with its own followed by its identity public key and
+// their signature of both ephemeral keys, and both derive the session ciphers.
+func (socket *socket) negotiate(identityKey ed25519.PrivateKey) error {
+	clientKey, err := socket.receiveMessage()
 	if err != nil {
-		socket.logger.ErrLog.Printf("ERR couldn't parse server pem public key: %s\n", err)
+		socket.logger.ErrLog.Printf("ERR couldn't read client public key from connection: %s\n", err)
 		return err
 	}
-	socket.serverPublicKey = serverPublicKey
-	err = socket.sendMessage([]byte("SERVER RECEIVED KEY"))
+
+	privateKey, err := GenerateSessionKeyPair()
 	if err != nil {
-		socket.logger.ErrLog.Println(fmt.Sprintf("Error while sending response: %s\n", err))
+		socket.logger.ErrLog.Printf("ERR couldn't generate session key pair: %s\n", err)
 		return err
 	}
+	serverKey := privateKey.PublicKey().Bytes()
 
-	publicKey, err := PublicKeyToPEM(&socket.serverPrivateKey.PublicKey)
+	socket.receiveCipher, socket.sendCipher, err = sessionCiphers(privateKey, clientKey, clientKey, serverKey)
 	if err != nil {
-		socket.logger.ErrLog.Printf("ERR attempt to encode client public key failed: %s\n", err)
+		socket.logger.ErrLog.Printf("ERR couldn't derive session keys: %s\n", err)
 		return err
 	}
 
-	err = socket.sendMessage(publicKey)
+	signature := ed25519.Sign(identityKey, handshakeTranscript(clientKey, serverKey))
+	err = socket.sendMessage(slices.Concat(serverKey, identityKey.Public().(ed25519.PublicKey), signature))
 	if err != nil {
-		socket.logger.ErrLog.Println(fmt.Sprintf("Error while sending client public key: %s\n", err))
+		socket.logger.ErrLog.Println(fmt.Sprintf("Error while sending server public key: %s\n", err))
 		return err
 	}
 	return nil
 }
 
 func (lebreServer *LebreServer) newCache() {
-	lebreServer.cache = cache{
-		Data:            make(map[string]cacheNode),
-		Capacity:        lebreServer.ServerConfig.PoolConfig.NodeLimit,
-		CumulativeBytes: 0,
-		NodeTimeToLive:  lebreServer.ServerConfig.PoolConfig.TimeToLive,
-		NodeSize:        lebreServer.ServerConfig.PoolConfig.NodeSize,
-		LimitInBytes:    lebreServer.ServerConfig.PoolConfig.NodeLimit,
-	}
+	lebreServer.cache = newCache(lebreServer.ServerConfig.PoolConfig, lebreServer.pubsub)
 }
 
 func (lebreServer *LebreServer) backup() {
-	cacheData, err := json.MarshalIndent(lebreServer.cache, "", "    ")
+	lebreServer.backups.Lock()
+	defer lebreServer.backups.Unlock()
+
+	backup := struct {
+		Data map[string]cacheNode `json:"data"`
+		// Read after the data so it covers every version and lock token handed out
+		Version uint64 `json:"version"`
+	}{
+		Data: lebreServer.cache.snapshot(),
+	}
+	backup.Version = lebreServer.cache.version.Load()
+
+	cacheData, err := json.MarshalIndent(&backup, "", "    ")
 	if err != nil {
 		fmt.Println("Error marshalling JSON: ", err)
 		return
@@ -187,6 +415,12 @@ func (lebreServer *LebreServer) backup() {
 	}
 }
 
+// backupNode also reads the text values of backups written before values were binary
+type backupNode struct {
+	cacheNode
+	Text *string `json:"value"`
+}
+
 func (lebreServer *LebreServer) readFromBackup() error {
 	if lebreServer.ServerConfig.PoolConfig.BackupOn {
 		fileData, err := os.ReadFile("backup.json")
@@ -194,18 +428,40 @@ func (lebreServer *LebreServer) readFromBackup() error {
 			fmt.Println("Error reading JSON file: ", err)
 			return err
 		}
-		err = json.Unmarshal(fileData, lebreServer.cache)
+		// only the nodes are restored, limits come from the current configuration
+		var backup struct {
+			Data    map[string]backupNode `json:"data"`
+			Version uint64                `json:"version"`
+		}
+		err = json.Unmarshal(fileData, &backup)
 		if err != nil {
 			fmt.Println("Error unmarshalling JSON: ", err)
 			return err
 		}
 
+		data := make(map[string]cacheNode, len(backup.Data))
+		for key, node := range backup.Data {
+			if node.Text != nil {
+				node.Value = []byte(*node.Text)
+			}
+			data[key] = node.cacheNode
+		}
+
+		lebreServer.newCache()
+		lebreServer.cache.restore(data, backup.Version)
+
 		return nil
 	}
 
 	return fmt.Errorf("backup is off")
 }
 
+// isUser reports whether user is the configured user
+func (lebreServer *LebreServer) isUser(user string) bool {
+	userHash := sha256.Sum256([]byte(user))
+	return lebreServer.ServerConfig.User == hex.EncodeToString(userHash[:])
+}
+
 func (lebreServer *LebreServer) handleConnection(
 	conn net.Conn,
 	semaphore chan struct{},
@@ -213,48 +469,71 @@ func (lebreServer *LebreServer) handleConnection(
 	defer func() { <-semaphore }()
 	defer conn.Close()
 
-	authorized := false
 	semaphore <- struct{}{}
 	logger := NewCli()
-	serverPrivateKey, _, err := GenerateRSAKeyPair()
-	if err != nil {
-		fmt.Println("Error generating RSA key pair:", err)
-		conn.Close()
-		return
-	}
 
 	ConnectionTimeout := time.Duration(lebreServer.ServerConfig.PoolConfig.ConnectionTimeout)
 	conn.SetDeadline(time.Now().Add(time.Millisecond * ConnectionTimeout))
 
 	socket := &socket{
-		serverPrivateKey: serverPrivateKey,
-		logger:           NewCli(),
-		conn:             conn,
+		logger:       NewCli(),
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		writeTimeout: time.Millisecond * ConnectionTimeout,
 	}
 
-	err = socket.negotiate()
-	if err != nil {
-		conn.Close()
-		return
-	}
+	authorized := false
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			logger.ErrLog.Printf("ERR TLS handshake failed: %s\n", err)
+			return
+		}
 
-	// var buffer bytes.Buffer
-	reader := bufio.NewReader(conn)
-	for {
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * ConnectionTimeout))
-		lengthBytes := make([]byte, 4)
-		_, err := io.ReadFull(reader, lengthBytes)
+		user, ok := lebreServer.ServerConfig.TLS.certificateUser(tlsConn.ConnectionState())
+		if ok && lebreServer.isUser(user) {
+			logger.Log(fmt.Sprintf("[LOG]: Authenticated by certificate with user: %s", user))
+			authorized = true
+		}
+	} else if lebreServer.ServerConfig.EnableEncryption {
+		err := socket.negotiate(lebreServer.identityKey)
 		if err != nil {
-			logger.ErrLog.Printf("ERR failed to read message length: %s\n", err)
+			conn.Close()
 			return
 		}
+	} else if !lebreServer.ServerConfig.AllowRemotePlaintext && !isLoopback(conn.LocalAddr()) {
+		logger.ErrLog.Printf("ERR refused unencrypted connection from %s on a non loopback interface\n", conn.RemoteAddr())
+		socket.respond("ERR unencrypted connections are only accepted on loopback interfaces")
+		return
+	}
+
+	session := &session{
+		socket:     socket,
+		logger:     logger,
+		authorized: authorized,
+		closed:     make(chan struct{}),
+	}
+	defer close(session.closed)
+	defer func() {
+		for name, token := range session.locks {
+			lebreServer.cache.Unlock(name, token)
+		}
+		if session.subscriber != nil {
+			lebreServer.pubsub.unsubscribe(session.subscriber, nil, false)
+			lebreServer.pubsub.unsubscribe(session.subscriber, nil, true)
+		}
+	}()
 
-		// retrieve first 32 bits containing the message length integer
-		messageLength := binary.BigEndian.Uint32(lengthBytes)
-		messageBytes := make([]byte, messageLength)
-		_, err = io.ReadFull(reader, messageBytes)
+	for {
+		if session.subscriber.subscriptions() > 0 {
+			// subscribers wait for messages without sending anything
+			conn.SetReadDeadline(time.Time{})
+		} else {
+			conn.SetReadDeadline(time.Now().Add(time.Millisecond * ConnectionTimeout))
+		}
+		messageBytes, err := socket.receiveMessage()
 		if err != nil {
-			logger.ErrLog.Printf("ERR failed to read message: %s\n", err)
+			logger.ErrLog.Printf("ERR %s\n", err)
 			return
 		}
 		requestParts, err := socket.getRequestParts(messageBytes)
@@ -264,123 +543,1205 @@ func (lebreServer *LebreServer) handleConnection(
 			return
 		}
 
-		commandParts := requestParts[1:]
+		if len(requestParts) < 2 {
+			continue
+		}
 
-		if len(commandParts) == 0 {
+		if session.subscriber.subscriptions() > 0 && !pushModeVerbs[requestParts[1]] {
+			socket.respond("ERR only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE and PUNSUBSCRIBE are allowed while subscribed")
 			continue
 		}
 
-		switch commandParts[0] {
-		case "AUTH":
-			logger.Log(fmt.Sprintf("[REQUEST]: %s %x", strings.Join(requestParts[0:2], " "), sha256.Sum256([]byte(requestParts[3]))))
-			if len(commandParts) != 3 {
-				socket.respond("ERR wrong number of arguments for AUTH")
-				continue
+		reply := lebreServer.dispatch(session, requestParts)
+		if reply != "" {
+			socket.respond(reply)
+		}
+	}
+}
+
+// execute runs a single request and returns the reply to send, empty if the
+// verb doesn't reply.
+func (lebreServer *LebreServer) execute(session *session, requestParts []string) string {
+	logger := session.logger
+	commandParts := requestParts[1:]
+	var err error
+
+	switch commandParts[0] {
+	case "AUTH":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 3)))
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for AUTH"
+		}
+
+		incomingPasswordHash := sha256.Sum256([]byte(commandParts[2]))
+		incomingPasswordHashString := hex.EncodeToString(incomingPasswordHash[:])
+
+		if !lebreServer.isUser(commandParts[1]) ||
+			lebreServer.credentials.Password != incomingPasswordHashString {
+			return "ERR authentication faild"
+		}
+
+		logger.Log(fmt.Sprintf("[LOG]: Authenticated with user: %s", commandParts[1]))
+
+		session.authorized = true
+		return ""
+
+	case "SET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 3)))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return "ERR wrong number of arguments for SET"
+		}
+		options, err := parseSetOptions(commandParts[3:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		value := []byte(requestValue(requestParts, commandParts[2]))
+		stored, err := lebreServer.cache.SetIf(commandParts[1], value, options)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if !stored {
+			return "NOT_STORED"
+		}
+
+		return "OK"
+
+	case "SETNX":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 3)))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for SETNX"
+		}
+		value := []byte(requestValue(requestParts, commandParts[2]))
+		stored, err := lebreServer.cache.SetIf(commandParts[1], value, setOptions{onlyIfMissing: true})
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if !stored {
+			return "NOT_STORED"
+		}
+
+		return "OK"
+
+	case "GETSET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 3)))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for GETSET"
+		}
+		value := []byte(requestValue(requestParts, commandParts[2]))
+		previous, ok, err := lebreServer.cache.GetSet(commandParts[1], value)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %s", previous)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "GETDEL":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for GETDEL"
+		}
+		value, ok, err := lebreServer.cache.GetDelete(commandParts[1])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %s", value)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "GETS":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for GETS"
+		}
+		value, version, ok, err := lebreServer.cache.GetWithVersion(commandParts[1])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %d %s", version, value)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "CAS":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 4)))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 && len(commandParts) != 6 {
+			return "ERR wrong number of arguments for CAS"
+		}
+		version, err := strconv.ParseUint(commandParts[2], 10, 64)
+		if err != nil {
+			return fmt.Sprintf("ERR invalid version '%s'", commandParts[2])
+		}
+		var ttl time.Duration
+		if len(commandParts) == 6 {
+			ttl, err = parseTimeToLive(commandParts[4], commandParts[5])
+			if err != nil {
+				return fmt.Sprintf("ERR %s", err)
 			}
+		}
+		value := []byte(requestValue(requestParts, commandParts[3]))
+		result, err := lebreServer.cache.CompareAndSwap(commandParts[1], version, value, ttl)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		switch result {
+		case casStored:
+			return "OK"
+		case casConflict:
+			return "EXISTS"
+		default:
+			return "NOT_FOUND"
+		}
 
-			incomingUserHash := sha256.Sum256([]byte(commandParts[1]))
-			incomingPasswordHash := sha256.Sum256([]byte(commandParts[2]))
-			incomingUserHashString := hex.EncodeToString(incomingUserHash[:])
-			incomingPasswordHashString := hex.EncodeToString(incomingPasswordHash[:])
+	case "GET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for GET"
+		}
+		value, ok, err := lebreServer.cache.Get(commandParts[1])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %s", value)
+		} else {
+			return "NOT_FOUND"
+		}
 
-			if lebreServer.credentials.User != incomingUserHashString ||
-				lebreServer.credentials.Password != incomingPasswordHashString {
-				socket.respond("ERR authentication faild")
-				continue
+	case "DELETE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for DELETE"
+		}
+		// a single key keeps the original reply
+		if len(commandParts) == 2 {
+			lebreServer.cache.Delete(commandParts[1])
+			return "OK"
+		}
+		return fmt.Sprintf("INTEGER %d", lebreServer.cache.DeleteMany(commandParts[1:]))
+
+	case "MDEL":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for MDEL"
+		}
+		return fmt.Sprintf("INTEGER %d", lebreServer.cache.DeleteMany(commandParts[1:]))
+
+	case "EXISTS":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for EXISTS"
+		}
+		return fmt.Sprintf("INTEGER %d", lebreServer.cache.Exists(commandParts[1:]))
+
+	case "MGET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for MGET"
+		}
+		values, found := lebreServer.cache.GetMany(commandParts[1:])
+		replies := make([]string, len(values))
+		for i, value := range values {
+			replies[i] = string(value)
+		}
+		return valuesReply(replies, found)
+
+	case "MSET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s %s", requestParts[0], commandParts[0]))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 || len(commandParts)%2 == 0 {
+			return "ERR wrong number of arguments for MSET"
+		}
+		keys := make([]string, 0, len(commandParts)/2)
+		values := make([][]byte, 0, len(commandParts)/2)
+		for i := 1; i < len(commandParts); i += 2 {
+			keys = append(keys, commandParts[i])
+			values = append(values, []byte(requestValue(requestParts, commandParts[i+1])))
+		}
+		err := lebreServer.cache.SetMany(keys, values)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return "OK"
+
+	case "INFO":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		return fmt.Sprintf("INFO %s", strings.Join(lebreServer.cache.Info(), " "))
+
+	case "EXPIRE", "PEXPIRE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		amount, err := strconv.ParseInt(commandParts[2], 10, 64)
+		if err != nil {
+			return fmt.Sprintf("ERR invalid expire time '%s'", commandParts[2])
+		}
+		// a lifetime that is already over deletes the key
+		var ttl time.Duration
+		if amount > 0 {
+			unit := "EX"
+			if commandParts[0] == "PEXPIRE" {
+				unit = "PX"
 			}
+			ttl, err = parseTimeToLive(unit, commandParts[2])
+			if err != nil {
+				return fmt.Sprintf("ERR %s", err)
+			}
+		}
+		if lebreServer.cache.Expire(commandParts[1], ttl) {
+			return "OK"
+		} else {
+			return "NOT_FOUND"
+		}
 
-			logger.Log(fmt.Sprintf("[LOG]: Authenticated with user: %s", commandParts[1]))
+	case "TTL", "PTTL":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		ttl, ok := lebreServer.cache.TimeToLive(commandParts[1])
+		switch {
+		case !ok:
+			return "NOT_FOUND"
+		case ttl < 0:
+			return "INTEGER -1"
+		case commandParts[0] == "PTTL":
+			return fmt.Sprintf("INTEGER %d", ttl.Milliseconds())
+		default:
+			return fmt.Sprintf("INTEGER %d", int64(ttl.Round(time.Second)/time.Second))
+		}
 
-			authorized = true
+	case "PERSIST":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for PERSIST"
+		}
+		if lebreServer.cache.Persist(commandParts[1]) {
+			return "OK"
+		} else {
+			return "NOT_FOUND"
+		}
 
-		case "SET":
-			logger.Log(fmt.Sprintf("[REQUEST]: %s %x", strings.Join(requestParts[0:3], " "), sha256.Sum256([]byte(requestParts[3]))))
-			if !authorized {
-				socket.respond("ERR unauthorized")
-				continue
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		delta := int64(1)
+		switch commandParts[0] {
+		case "INCR", "DECR":
+			if len(commandParts) != 2 {
+				return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
 			}
+		default:
 			if len(commandParts) != 3 {
-				socket.respond("ERR wrong number of arguments for SET")
-				continue
+				return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
 			}
-			value := strings.ReplaceAll(commandParts[2], "\\u0020", "\u0020")
-			err := lebreServer.cache.Set(commandParts[1], value)
+			delta, err = strconv.ParseInt(commandParts[2], 10, 64)
 			if err != nil {
-				socket.respond(fmt.Sprintf("ERR %s", err))
-				continue
+				return "ERR value is not an integer or out of range"
 			}
+		}
+		if commandParts[0] == "DECR" || commandParts[0] == "DECRBY" {
+			if delta == math.MinInt64 {
+				return "ERR decrement would overflow"
+			}
+			delta = -delta
+		}
+		result, err := lebreServer.cache.IncrementBy(commandParts[1], delta)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", result)
 
-			socket.respond("OK")
+	case "INCRBYFLOAT":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for INCRBYFLOAT"
+		}
+		delta, err := strconv.ParseFloat(commandParts[2], 64)
+		if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+			return "ERR value is not a valid float"
+		}
+		result, err := lebreServer.cache.IncrementByFloat(commandParts[1], delta)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("VALUE %s", strconv.FormatFloat(result, 'f', -1, 64))
 
-		case "GET":
-			logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
-			if !authorized {
-				socket.respond("ERR unauthorized")
-				continue
+	case "SCAN":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 || len(commandParts)%2 != 0 {
+			return "ERR wrong number of arguments for SCAN"
+		}
+		cursor, err := strconv.ParseUint(commandParts[1], 10, 64)
+		if err != nil {
+			return fmt.Sprintf("ERR invalid cursor '%s'", commandParts[1])
+		}
+		pattern, count := "", defaultScanCount
+		for i := 2; i < len(commandParts) && err == nil; i += 2 {
+			switch strings.ToUpper(commandParts[i]) {
+			case "MATCH":
+				pattern = commandParts[i+1]
+			case "COUNT":
+				count, err = strconv.Atoi(commandParts[i+1])
+				if err == nil && count <= 0 {
+					err = fmt.Errorf("invalid count '%s'", commandParts[i+1])
+				}
+			default:
+				err = fmt.Errorf("syntax error near '%s'", commandParts[i])
 			}
-			if len(commandParts) != 2 {
-				socket.respond("ERR wrong number of arguments for GET")
-				continue
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		next, keys := lebreServer.cache.Scan(cursor, pattern, count)
+		return scanReply(next, keys)
+
+	case "DBSIZE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		return fmt.Sprintf("INTEGER %d", lebreServer.cache.Size())
+
+	case "HSET":
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 4 || len(commandParts)%2 != 0 {
+			return "ERR wrong number of arguments for HSET"
+		}
+		// logged once the key is known to be there, values are left out
+		logger.Log(fmt.Sprintf("[REQUEST]: %s %s %s", requestParts[0], commandParts[0], commandParts[1]))
+		fields := make([]string, 0, len(commandParts)/2-1)
+		values := make([]string, 0, len(commandParts)/2-1)
+		for i := 2; i < len(commandParts); i += 2 {
+			fields = append(fields, commandParts[i])
+			values = append(values, requestValue(requestParts, commandParts[i+1]))
+		}
+		added, err := lebreServer.cache.HashSet(commandParts[1], fields, values)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", added)
+
+	case "HGET":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for HGET"
+		}
+		value, ok, err := lebreServer.cache.HashGet(commandParts[1], commandParts[2])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %s", value)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "HDEL":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return "ERR wrong number of arguments for HDEL"
+		}
+		removed, err := lebreServer.cache.HashDelete(commandParts[1], commandParts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", removed)
+
+	case "HGETALL":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for HGETALL"
+		}
+		items, err := lebreServer.cache.HashGetAll(commandParts[1])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return valuesReply(items, nil)
+
+	case "HINCRBY":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 {
+			return "ERR wrong number of arguments for HINCRBY"
+		}
+		delta, err := strconv.ParseInt(commandParts[3], 10, 64)
+		if err != nil {
+			return "ERR value is not an integer"
+		}
+		result, err := lebreServer.cache.HashIncrementBy(commandParts[1], commandParts[2], delta)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", result)
+
+	case "LPUSH", "RPUSH":
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		logger.Log(fmt.Sprintf("[REQUEST]: %s %s %s", requestParts[0], commandParts[0], commandParts[1]))
+		values := make([]string, 0, len(commandParts)-2)
+		for _, value := range commandParts[2:] {
+			values = append(values, requestValue(requestParts, value))
+		}
+		length, err := lebreServer.cache.Push(commandParts[1], values, commandParts[0] == "LPUSH")
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", length)
+
+	case "LPOP", "RPOP":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		value, ok, err := lebreServer.cache.Pop(commandParts[1], commandParts[0] == "LPOP")
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("VALUE %s", value)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "BLPOP", "BRPOP":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		seconds, err := strconv.ParseFloat(commandParts[len(commandParts)-1], 64)
+		if err != nil || math.IsNaN(seconds) || seconds < 0 || seconds > float64(math.MaxInt64/int64(time.Second)) {
+			return "ERR timeout is not a valid float or out of range"
+		}
+		disconnected, stopWatching := session.socket.watchDisconnect()
+		key, value, ok, err := lebreServer.cache.BlockingPop(
+			commandParts[1:len(commandParts)-1],
+			commandParts[0] == "BLPOP",
+			time.Duration(seconds*float64(time.Second)),
+			lebreServer.done,
+			disconnected,
+		)
+		stopWatching()
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return valuesReply([]string{key, value}, nil)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "LRANGE", "LTRIM":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		start, err := strconv.Atoi(commandParts[2])
+		if err != nil {
+			return "ERR value is not an integer"
+		}
+		stop, err := strconv.Atoi(commandParts[3])
+		if err != nil {
+			return "ERR value is not an integer"
+		}
+		if commandParts[0] == "LTRIM" {
+			err = lebreServer.cache.Trim(commandParts[1], start, stop)
+			if err != nil {
+				return fmt.Sprintf("ERR %s", err)
 			}
-			value, ok := lebreServer.cache.Get(commandParts[1])
-			if ok && len(value) > 0 {
-				socket.respond(fmt.Sprintf("VALUE %s", value))
-			} else {
-				socket.respond("NOT_FOUND")
+			return "OK"
+		}
+		items, err := lebreServer.cache.Range(commandParts[1], start, stop)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return valuesReply(items, nil)
+
+	case "LLEN":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 2 {
+			return "ERR wrong number of arguments for LLEN"
+		}
+		length, err := lebreServer.cache.Length(commandParts[1])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", length)
+
+	case "SADD", "SREM":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		var count int
+		if commandParts[0] == "SADD" {
+			count, err = lebreServer.cache.SetAdd(commandParts[1], commandParts[2:])
+		} else {
+			count, err = lebreServer.cache.SetRemove(commandParts[1], commandParts[2:])
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", count)
+
+	case "SISMEMBER":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for SISMEMBER"
+		}
+		member, err := lebreServer.cache.SetIsMember(commandParts[1], commandParts[2])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if member {
+			return "INTEGER 1"
+		} else {
+			return "INTEGER 0"
+		}
+
+	case "SMEMBERS", "SINTER", "SUNION":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 || (commandParts[0] == "SMEMBERS" && len(commandParts) != 2) {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		var members []string
+		switch commandParts[0] {
+		case "SINTER":
+			members, err = lebreServer.cache.SetIntersect(commandParts[1:])
+		case "SUNION":
+			members, err = lebreServer.cache.SetUnion(commandParts[1:])
+		default:
+			members, err = lebreServer.cache.SetMembers(commandParts[1])
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return valuesReply(members, nil)
+
+	case "ZADD":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 4 || len(commandParts)%2 != 0 {
+			return "ERR wrong number of arguments for ZADD"
+		}
+		members := make([]string, 0, len(commandParts)/2-1)
+		scores := make([]float64, 0, len(commandParts)/2-1)
+		for i := 2; i < len(commandParts); i += 2 {
+			score, err := strconv.ParseFloat(commandParts[i], 64)
+			if err != nil || math.IsNaN(score) {
+				break
 			}
+			scores = append(scores, score)
+			members = append(members, commandParts[i+1])
+		}
+		if len(members) != len(commandParts)/2-1 {
+			return "ERR value is not a valid float"
+		}
+		added, err := lebreServer.cache.SortedAdd(commandParts[1], members, scores)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", added)
 
-		case "DELETE":
-			logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
-			if !authorized {
-				socket.respond("ERR unauthorized")
-				continue
+	case "ZINCRBY":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 {
+			return "ERR wrong number of arguments for ZINCRBY"
+		}
+		delta, err := strconv.ParseFloat(commandParts[2], 64)
+		if err != nil || math.IsNaN(delta) {
+			return "ERR value is not a valid float"
+		}
+		score, err := lebreServer.cache.SortedIncrementBy(commandParts[1], commandParts[3], delta)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("VALUE %s", formatScore(score))
+
+	case "ZRANGE", "ZRANGEBYSCORE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		withScores := len(commandParts) == 5 && commandParts[4] == "WITHSCORES"
+		if len(commandParts) != 4 && !withScores {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		var entries []sortedEntry
+		if commandParts[0] == "ZRANGE" {
+			start, startErr := strconv.Atoi(commandParts[2])
+			stop, stopErr := strconv.Atoi(commandParts[3])
+			if startErr != nil || stopErr != nil {
+				return "ERR value is not an integer"
 			}
-			if len(commandParts) != 2 {
-				socket.respond("ERR wrong number of arguments for DELETE")
-				continue
+			entries, err = lebreServer.cache.SortedRange(commandParts[1], start, stop)
+		} else {
+			min, minErr := parseScoreBound(commandParts[2])
+			max, maxErr := parseScoreBound(commandParts[3])
+			if minErr != nil || maxErr != nil {
+				return "ERR min or max is not a float"
 			}
-			lebreServer.cache.Delete(commandParts[1])
-			socket.respond("OK")
+			entries, err = lebreServer.cache.SortedRangeByScore(commandParts[1], min, max)
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return entriesReply(entries, withScores)
 
-		default:
-			if !authorized {
-				socket.respond("ERR unauthorized")
-				continue
+	case "ZRANK":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for ZRANK"
+		}
+		rank, ok, err := lebreServer.cache.SortedRank(commandParts[1], commandParts[2])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if ok {
+			return fmt.Sprintf("INTEGER %d", rank)
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "ZREM":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return "ERR wrong number of arguments for ZREM"
+		}
+		removed, err := lebreServer.cache.SortedRemove(commandParts[1], commandParts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", removed)
+
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		if session.subscriber == nil {
+			session.subscriber = newSubscriber(lebreServer.ServerConfig.PoolConfig.SubscriberBufferLimit)
+			go session.subscriber.forward(session.socket, session.closed)
+		}
+		// confirmed through the subscriber queue, ahead of any message
+		lebreServer.pubsub.subscribe(session.subscriber, commandParts[1:], commandParts[0] == "PSUBSCRIBE")
+		return ""
+
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if session.subscriber == nil {
+			return fmt.Sprintf("%sD 0", commandParts[0])
+		}
+		// confirmed through the subscriber queue, ahead of any message
+		lebreServer.pubsub.unsubscribe(session.subscriber, commandParts[1:], commandParts[0] == "PUNSUBSCRIBE")
+		return ""
+
+	case "PUBLISH":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", redactRequest(requestParts, 3)))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for PUBLISH"
+		}
+		message := requestValue(requestParts, commandParts[2])
+		received := lebreServer.pubsub.Publish(commandParts[1], message)
+		return fmt.Sprintf("INTEGER %d", received)
+
+	case "EVAL", "EVALSHA":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		keys, args, err := scriptArguments(commandParts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		var program *script
+		if commandParts[0] == "EVAL" {
+			program, err = lebreServer.loadScript(requestValue(requestParts, commandParts[1]))
+			if err != nil {
+				return fmt.Sprintf("ERR script: %s", err)
+			}
+		} else {
+			cached, ok := lebreServer.scripts.Load(strings.ToLower(commandParts[1]))
+			if !ok {
+				return "ERR NOSCRIPT no matching script, use EVAL"
+			}
+			program = cached.(*script)
+		}
+		return lebreServer.evalScript(session, program, keys, args)
+
+	case "SCRIPT":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 || commandParts[1] != "LOAD" {
+			return "ERR usage: SCRIPT LOAD script"
+		}
+		script, err := lebreServer.loadScript(requestValue(requestParts, commandParts[2]))
+		if err != nil {
+			return fmt.Sprintf("ERR script: %s", err)
+		}
+		return fmt.Sprintf("VALUE %s", script.sha)
+
+	case "LOCK":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		bound := len(commandParts) == 4 && commandParts[3] == "SESSION"
+		if len(commandParts) != 3 && !bound {
+			return "ERR wrong number of arguments for LOCK"
+		}
+		ttl, err := parseTimeToLive("PX", commandParts[2])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		token, ok := lebreServer.cache.Lock(commandParts[1], ttl)
+		if !ok {
+			return "NOT_STORED"
+		}
+		if bound {
+			if session.locks == nil {
+				session.locks = make(map[string]uint64)
+			}
+			session.locks[commandParts[1]] = token
+		}
+		return fmt.Sprintf("INTEGER %d", token)
+
+	case "RENEW":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 {
+			return "ERR wrong number of arguments for RENEW"
+		}
+		token, err := strconv.ParseUint(commandParts[2], 10, 64)
+		if err != nil {
+			return "ERR invalid token"
+		}
+		ttl, err := parseTimeToLive("PX", commandParts[3])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if lebreServer.cache.Renew(commandParts[1], token, ttl) {
+			return "OK"
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "UNLOCK":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return "ERR wrong number of arguments for UNLOCK"
+		}
+		token, err := strconv.ParseUint(commandParts[2], 10, 64)
+		if err != nil {
+			return "ERR invalid token"
+		}
+		if session.locks[commandParts[1]] == token {
+			delete(session.locks, commandParts[1])
+		}
+		if lebreServer.cache.Unlock(commandParts[1], token) {
+			return "OK"
+		} else {
+			return "NOT_FOUND"
+		}
+
+	case "RATELIMIT":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 4 || len(commandParts) > 6 {
+			return "ERR wrong number of arguments for RATELIMIT"
+		}
+		limit, err := strconv.ParseInt(commandParts[2], 10, 64)
+		if err != nil || limit <= 0 {
+			return "ERR limit must be a positive integer"
+		}
+		milliseconds, err := strconv.ParseInt(commandParts[3], 10, 64)
+		if err != nil || milliseconds <= 0 || milliseconds > math.MaxInt64/int64(time.Millisecond) {
+			return fmt.Sprintf("ERR %s", errInvalidWindow)
+		}
+		window := time.Duration(milliseconds) * time.Millisecond
+		cost, bucket := int64(1), false
+		options := commandParts[4:]
+		if last := len(options) - 1; last >= 0 && (options[last] == "SLIDING" || options[last] == "BUCKET") {
+			bucket = options[last] == "BUCKET"
+			options = options[:last]
+		}
+		if len(options) == 1 {
+			cost, err = strconv.ParseInt(options[0], 10, 64)
+			if err != nil || cost <= 0 || cost > limit {
+				return "ERR cost must be a positive integer no larger than the limit"
 			}
-			socket.respond("ERR unknown verb")
+		} else if len(options) > 1 {
+			return "ERR syntax error"
+		}
+		result, err := lebreServer.cache.RateLimit(commandParts[1], limit, cost, window, bucket)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		allowed := "0"
+		if result.allowed {
+			allowed = "1"
+		}
+		return valuesReply([]string{
+			allowed,
+			strconv.FormatInt(result.remaining, 10),
+			strconv.FormatInt(result.resetAfter.Milliseconds(), 10),
+		}, nil)
+
+	case "BF.RESERVE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 4 {
+			return "ERR wrong number of arguments for BF.RESERVE"
+		}
+		errorRate, err := strconv.ParseFloat(commandParts[2], 64)
+		if err != nil || errorRate <= 0 || errorRate >= 1 {
+			return "ERR error rate must be a number between 0 and 1"
+		}
+		capacity, err := strconv.ParseUint(commandParts[3], 10, 64)
+		if err != nil || capacity == 0 {
+			return "ERR capacity must be a positive integer"
+		}
+		err = lebreServer.cache.BloomReserve(commandParts[1], errorRate, capacity)
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return "OK"
+
+	case "BF.ADD", "BF.EXISTS":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) != 3 {
+			return fmt.Sprintf("ERR wrong number of arguments for %s", commandParts[0])
+		}
+		var result bool
+		if commandParts[0] == "BF.ADD" {
+			result, err = lebreServer.cache.BloomAdd(commandParts[1], commandParts[2])
+		} else {
+			result, err = lebreServer.cache.BloomExists(commandParts[1], commandParts[2])
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if result {
+			return "INTEGER 1"
+		} else {
+			return "INTEGER 0"
+		}
+
+	case "PFADD":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for PFADD"
+		}
+		changed, err := lebreServer.cache.HyperLogLogAdd(commandParts[1], commandParts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		if changed {
+			return "INTEGER 1"
+		} else {
+			return "INTEGER 0"
+		}
+
+	case "PFCOUNT":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for PFCOUNT"
+		}
+		count, err := lebreServer.cache.HyperLogLogCount(commandParts[1:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return fmt.Sprintf("INTEGER %d", count)
+
+	case "PFMERGE":
+		logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for PFMERGE"
+		}
+		err = lebreServer.cache.HyperLogLogMerge(commandParts[1], commandParts[2:])
+		if err != nil {
+			return fmt.Sprintf("ERR %s", err)
+		}
+		return "OK"
+
+	default:
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+		return "ERR unknown verb"
+	}
+}
+
+// Stop closes the listener and ends the background maintenance loops, taking a last
+// backup first when backups are on so Start only returns once it is written.
+// It can be called more than once, and before Start which then returns right away.
+func (lebreServer *LebreServer) Stop() {
+	lebreServer.lifecycle.Lock()
+	defer lebreServer.lifecycle.Unlock()
+
+	if lebreServer.stopped {
+		return
+	}
+	lebreServer.stopped = true
+	if lebreServer.done != nil {
+		close(lebreServer.done)
+		if lebreServer.ServerConfig.PoolConfig.BackupOn {
+			lebreServer.backup()
 		}
 	}
+	if lebreServer.listener != nil {
+		lebreServer.listener.Close()
+	}
 }
 
 func (lebreServer *LebreServer) Start() {
-	err := lebreServer.readFromBackup()
+	cli := NewCli()
+
+	_, err := newEvictionPolicy(lebreServer.ServerConfig.PoolConfig.EvictionPolicy)
+	if err != nil {
+		cli.Error(fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	_, err = parseKeyspaceEvents(lebreServer.ServerConfig.PoolConfig.KeyspaceEvents)
+	if err != nil {
+		cli.Error(fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	var serverTLSConfig *tls.Config
+	if lebreServer.ServerConfig.TLS != nil {
+		serverTLSConfig, err = lebreServer.ServerConfig.TLS.serverConfig()
+		if err != nil {
+			cli.Error(fmt.Sprintf("Error: %s", err))
+			return
+		}
+		for subject, user := range lebreServer.ServerConfig.TLS.Users {
+			if !lebreServer.isUser(user) {
+				cli.Error(fmt.Sprintf("Error: certificate '%s' is mapped to unknown user '%s'", subject, user))
+				return
+			}
+		}
+	}
+
+	if lebreServer.ServerConfig.TLS == nil && lebreServer.ServerConfig.EnableEncryption {
+		identityKeyPath := lebreServer.ServerConfig.IdentityKeyPath()
+		// servers set up before identity keys existed get one on their first start
+		err = GenerateIdentityKey(identityKeyPath)
+		if err == nil {
+			cli.Warning.Printf("Created the identity key %s, clients pinning the server need its new fingerprint\n", identityKeyPath)
+		} else if !errors.Is(err, os.ErrExist) {
+			cli.Error(fmt.Sprintf("Error: couldn't create the identity key: %s", err))
+			return
+		}
+
+		lebreServer.identityKey, err = LoadIdentityKey(identityKeyPath)
+		if err != nil {
+			cli.Error(fmt.Sprintf("Error: couldn't load the identity key: %s", err))
+			return
+		}
+	}
+
+	lebreServer.pubsub = newPubsub()
+	err = lebreServer.readFromBackup()
 	if err != nil {
 		lebreServer.newCache()
 	}
 
-	cli := NewCli()
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", lebreServer.ServerConfig.Port))
 	if err != nil {
 		cli.Error(fmt.Sprintf("Error: %s", err))
 		return
 	}
+	if serverTLSConfig != nil {
+		listener = tls.NewListener(listener, serverTLSConfig)
+	}
 	defer listener.Close()
 
+	lebreServer.lifecycle.Lock()
+	if lebreServer.stopped {
+		lebreServer.lifecycle.Unlock()
+		return
+	}
+	lebreServer.listener = listener
+	lebreServer.done = make(chan struct{})
+	lebreServer.lifecycle.Unlock()
+
 	lebreServer.credentials = &credentials{
 		User:     lebreServer.ServerConfig.User,
 		Password: lebreServer.ServerConfig.Password,
 	}
 	semaphore := make(chan struct{}, lebreServer.ServerConfig.PoolConfig.MaxConns)
 
+	go Interval(expiryCycleInterval, lebreServer.done, lebreServer.cache.activeExpiryCycle)
+
 	if lebreServer.ServerConfig.PoolConfig.BackupOn {
 		interval := time.Duration(lebreServer.ServerConfig.PoolConfig.BackupCycle) * time.Millisecond
-		go Interval(interval, lebreServer.backup)
+		go Interval(interval, lebreServer.done, lebreServer.backup)
 	}
 
 	cli.Launch(fmt.Sprintf("Lebre cache server initiated. Listening on port %d", lebreServer.ServerConfig.Port))
+	if lebreServer.identityKey != nil {
+		cli.Log(fmt.Sprintf("Server fingerprint: %s", Fingerprint(lebreServer.identityKey)))
+	}
+	if lebreServer.ServerConfig.TLS == nil && !lebreServer.ServerConfig.EnableEncryption {
+		if lebreServer.ServerConfig.AllowRemotePlaintext {
+			cli.Warning.Println("Encryption is disabled, unencrypted connections are accepted on every interface")
+		} else {
+			cli.Warning.Println("Encryption is disabled, only connections on loopback interfaces are accepted")
+		}
+	}
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			cli.Error(fmt.Sprintf("Error accepting connection: %s", err))
 			continue
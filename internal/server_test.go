@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "root"
+	testPassword = "password1234"
+)
+
+// startTestServer runs an unencrypted server on a free loopback port until the test ends
+func startTestServer(t *testing.T, configure func(*ServerConfig)) *LebreServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	serverConfig := DefaultServerConfig()
+	serverConfig.Port = uint32(port)
+	serverConfig.EnableEncryption = false
+	userHash := sha256.Sum256([]byte(testUser))
+	serverConfig.User = hex.EncodeToString(userHash[:])
+	passwordHash := sha256.Sum256([]byte(testPassword))
+	serverConfig.Password = hex.EncodeToString(passwordHash[:])
+	if configure != nil {
+		configure(serverConfig)
+	}
+
+	lebreServer := &LebreServer{ServerConfig: *serverConfig}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		lebreServer.Start()
+	}()
+
+	for range 100 {
+		conn, err := net.Dial("tcp", lebreServer.address())
+		if err == nil {
+			conn.Close()
+			t.Cleanup(func() {
+				lebreServer.Stop()
+				<-stopped
+			})
+			return lebreServer
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server didn't start")
+	return nil
+}
+
+func (lebreServer *LebreServer) address() string {
+	return net.JoinHostPort("127.0.0.1", fmt.Sprint(lebreServer.ServerConfig.Port))
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestServer connects an authorized client to lebreServer
+func dialTestServer(t *testing.T, lebreServer *LebreServer) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", lebreServer.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	client.send("AUTH", testUser, testPassword)
+	return client
+}
+
+func (client *testClient) write(message []byte) {
+	client.t.Helper()
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+	_, err := client.conn.Write(append(frame, message...))
+	if err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+func (client *testClient) read() string {
+	client.t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	length := make([]byte, 4)
+	_, err := io.ReadFull(client.reader, length)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	message := make([]byte, binary.BigEndian.Uint32(length))
+	_, err = io.ReadFull(client.reader, message)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return string(message)
+}
+
+// send writes a V2 request without waiting for its reply
+func (client *testClient) send(args ...string) {
+	client.t.Helper()
+	client.write(v2Request(args...))
+}
+
+// do sends a V2 request and returns its reply
+func (client *testClient) do(args ...string) string {
+	client.t.Helper()
+	client.send(args...)
+	return client.read()
+}
+
+// doV1 sends a V1 request and returns its reply
+func (client *testClient) doV1(request string) string {
+	client.t.Helper()
+	client.write([]byte("V1.0 " + request))
+	return client.read()
+}
+
+func v2Request(args ...string) []byte {
+	request := []byte(protocolV2)
+	for _, arg := range args {
+		request = binary.BigEndian.AppendUint32(request, uint32(len(arg)))
+		request = append(request, arg...)
+	}
+	return request
+}
+
+func expectReply(t *testing.T, request, reply, expected string) {
+	t.Helper()
+	if reply != expected {
+		t.Errorf("%s: got %q, expected %q", request, reply, expected)
+	}
+}
+
+func TestBlockingPopReleasesDisconnectedClients(t *testing.T) {
+	lebreServer := startTestServer(t, func(serverConfig *ServerConfig) {
+		serverConfig.PoolConfig.MaxConns = 2
+	})
+
+	for range 4 {
+		client := dialTestServer(t, lebreServer)
+		client.send("BLPOP", "never", "0")
+		client.conn.Close()
+	}
+
+	client := dialTestServer(t, lebreServer)
+	expectReply(t, "PUSH", client.do("RPUSH", "list", "a"), "INTEGER 1")
+}
+
+func TestBlockingPopKeepsPipelinedRequests(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+	pusher := dialTestServer(t, lebreServer)
+
+	client.send("BLPOP", "list", "0")
+	client.send("LLEN", "list")
+	time.Sleep(50 * time.Millisecond)
+	pusher.do("RPUSH", "list", "a", "b")
+
+	expectReply(t, "BLPOP", client.read(), "VALUES 2 $4 list $1 a")
+	expectReply(t, "LLEN", client.read(), "INTEGER 1")
+}
+
+func TestUncheckedArgumentsDontPanic(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	for _, verb := range []string{"HSET", "LPUSH", "RPUSH"} {
+		if reply := client.do(verb); !strings.HasPrefix(reply, "ERR wrong number of arguments") {
+			t.Errorf("%s: got %q", verb, reply)
+		}
+	}
+}
+
+func TestStartCreatesMissingIdentityKey(t *testing.T) {
+	identityKeyFile := filepath.Join(t.TempDir(), "identity.key")
+	configure := func(serverConfig *ServerConfig) {
+		serverConfig.EnableEncryption = true
+		serverConfig.IdentityKeyFile = identityKeyFile
+	}
+
+	startTestServer(t, configure)
+	created, err := os.ReadFile(identityKeyFile)
+	if err != nil {
+		t.Fatalf("no identity key was created: %s", err)
+	}
+
+	startTestServer(t, configure)
+	kept, _ := os.ReadFile(identityKeyFile)
+	if !bytes.Equal(created, kept) {
+		t.Error("the identity key created on the first start wasn't kept")
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	lebreServer.Stop()
+	lebreServer.Stop()
+
+	unstarted := &LebreServer{ServerConfig: *DefaultServerConfig()}
+	unstarted.ServerConfig.EnableEncryption = false
+	unstarted.Stop()
+	unstarted.Stop()
+
+	returned := make(chan struct{})
+	go func() {
+		unstarted.Start()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Error("a server stopped before it started kept running")
+	}
+}
+
+// nonLoopbackAddress is an address of this host outside of the loopback interfaces
+func nonLoopbackAddress(t *testing.T) string {
+	t.Helper()
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.To4() != nil && !network.IP.IsLoopback() {
+			return network.IP.String()
+		}
+	}
+	t.Skip("no non loopback interface to connect through")
+	return ""
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{&net.TCPAddr{IP: net.IPv4(127, 8, 0, 9)}, true},
+		{&net.TCPAddr{IP: net.IPv6loopback}, true},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, false},
+		{&net.TCPAddr{IP: net.IPv4zero}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, false},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, false},
+	}
+	for _, test := range tests {
+		if got := isLoopback(test.addr); got != test.expected {
+			t.Errorf("%s: got %t", test.addr, got)
+		}
+	}
+}
+
+func TestPlaintextRefusesRemoteConnections(t *testing.T) {
+	address := nonLoopbackAddress(t)
+
+	for _, allowRemote := range []bool{false, true} {
+		lebreServer := startTestServer(t, func(serverConfig *ServerConfig) {
+			serverConfig.AllowRemotePlaintext = allowRemote
+		})
+		conn, err := net.Dial("tcp", net.JoinHostPort(address, fmt.Sprint(lebreServer.ServerConfig.Port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+		if !allowRemote {
+			expectReply(t, "connecting", client.read(), "ERR unencrypted connections are only accepted on loopback interfaces")
+			if _, err := client.reader.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Errorf("a refused connection wasn't closed: %v", err)
+			}
+			continue
+		}
+		client.send("AUTH", testUser, testPassword)
+		expectReply(t, "GET", client.do("GET", "key"), "NOT_FOUND")
+	}
+}
+
+func TestParseTimeToLive(t *testing.T) {
+	tests := []struct {
+		unit, amount string
+		expected     time.Duration
+		valid        bool
+	}{
+		{"EX", "60", time.Minute, true},
+		{"px", "1500", 1500 * time.Millisecond, true},
+		{"EX", "9223372036", 9223372036 * time.Second, true},
+		{"EX", "9223372037", 0, false},
+		{"EX", "9223372036854775807", 0, false},
+		{"PX", "9223372036854", 9223372036854 * time.Millisecond, true},
+		{"PX", "9223372036855", 0, false},
+		{"PX", "288230376151711744", 0, false},
+		{"PX", "0", 0, false},
+		{"EX", "-1", 0, false},
+		{"EX", "9223372036854775808", 0, false},
+		{"XX", "60", 0, false},
+	}
+	for _, test := range tests {
+		ttl, err := parseTimeToLive(test.unit, test.amount)
+		if (err == nil) != test.valid || ttl != test.expected {
+			t.Errorf("%s %s: got %s, %v", test.unit, test.amount, ttl, err)
+		}
+	}
+}
+
+func TestExpireBounds(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+	client.do("SET", "k", "v")
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"EXPIRE", "k", "9223372036854775807"}, "ERR invalid expire time '9223372036854775807'"},
+		{[]string{"PEXPIRE", "k", "9223372036855"}, "ERR invalid expire time '9223372036855'"},
+		{[]string{"SET", "k", "v", "EX", "9223372036854775807"}, "ERR invalid expire time '9223372036854775807'"},
+		{[]string{"LOCK", "lock", "9223372036855"}, "ERR invalid expire time '9223372036855'"},
+		{[]string{"BLPOP", "list", "1e300"}, "ERR timeout is not a valid float or out of range"},
+		{[]string{"BLPOP", "list", "NaN"}, "ERR timeout is not a valid float or out of range"},
+		{[]string{"GET", "k"}, "VALUE v"},
+		{[]string{"EXPIRE", "k", "9223372036"}, "OK"},
+		{[]string{"GET", "k"}, "VALUE v"},
+		{[]string{"EXPIRE", "k", "0"}, "OK"},
+		{[]string{"GET", "k"}, "NOT_FOUND"},
+	}
+	for _, test := range tests {
+		expectReply(t, strings.Join(test.args, " "), client.do(test.args...), test.expected)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		request  string
+		expected []string
+	}{
+		{"V1.0 SET key  value\n", []string{"V1.0", "SET", "key", "value"}},
+		{string(v2Request("SET", "key with space", "")), []string{protocolV2, "SET", "key with space", ""}},
+		{string(v2Request("SET", "k", "a\x00b\nc")), []string{protocolV2, "SET", "k", "a\x00b\nc"}},
+		{protocolV2, []string{protocolV2}},
+	}
+	for _, test := range tests {
+		requestParts, err := parseRequest([]byte(test.request))
+		if err != nil || !slices.Equal(requestParts, test.expected) {
+			t.Errorf("%q: got %q, %v", test.request, requestParts, err)
+		}
+	}
+
+	for _, malformed := range []string{protocolV2 + "\x00\x00", protocolV2 + "\x00\x00\x00\x09GET"} {
+		if _, err := parseRequest([]byte(malformed)); err == nil {
+			t.Errorf("%q: expected an error", malformed)
+		}
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+	value := "a b\n\x00\xff\\u0020"
+
+	expectReply(t, "SET", client.do("SET", "key with space", value), "OK")
+	expectReply(t, "GET", client.do("GET", "key with space"), "VALUE "+value)
+	expectReply(t, "SET", client.do("SET", "empty", ""), "OK")
+	expectReply(t, "GET", client.do("GET", "empty"), "VALUE ")
+
+	// V1 values escape their spaces
+	expectReply(t, "SET", client.doV1(`SET text Hello\u0020World`), "OK")
+	expectReply(t, "GET", client.do("GET", "text"), "VALUE Hello World")
+	expectReply(t, "MGET", client.do("MGET", "key with space", "missing"), fmt.Sprintf("VALUES 2 $%d %s $-1", len(value), value))
+
+	client.write([]byte(protocolV2 + "\x00\x00\x00\x09GET"))
+	if _, err := client.reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("a malformed V2 request didn't close the connection: %v", err)
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	directory, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(directory)
+
+	// values were backed up as text before they were binary
+	legacy := `{"data":{"old":{"value":"hello world","expiry":"0001-01-01T00:00:00Z","version":7}},"version":9}`
+	os.WriteFile("backup.json", []byte(legacy), 0600)
+
+	lebreServer := &LebreServer{ServerConfig: *DefaultServerConfig()}
+	lebreServer.ServerConfig.PoolConfig.BackupOn = true
+	lebreServer.pubsub = newPubsub()
+	if err := lebreServer.readFromBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := lebreServer.cache.Get("old"); string(value) != "hello world" {
+		t.Errorf("legacy value read as %q", value)
+	}
+
+	lebreServer.cache.Set("binary", []byte("\x00\xff"), 0)
+	lebreServer.cache.HashSet("hash", []string{"field"}, []string{"value"})
+	lebreServer.backup()
+	if err := lebreServer.readFromBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := lebreServer.cache.Get("binary"); string(value) != "\x00\xff" {
+		t.Errorf("binary value read back as %q", value)
+	}
+	if value, _, _ := lebreServer.cache.HashGet("hash", "field"); value != "value" {
+		t.Errorf("hash field read back as %q", value)
+	}
+	if version := lebreServer.cache.version.Load(); version < 9 {
+		t.Errorf("versions restarted from %d", version)
+	}
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// SetAdd adds members to the set stored under key, creating it if needed.
+// Returns how many members were not already in the set.
+func (cache *cache) SetAdd(key string, members []string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, setKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cacheNode{
+			Kind:   setKind,
+			Set:    make(map[string]struct{}),
+			Expiry: expiryFrom(now, cache.defaultTimeToLive()),
+		}
+	}
+
+	added := make(map[string]struct{})
+	elementBytes := int(node.elementBytes)
+	for _, member := range members {
+		_, present := node.Set[member]
+		_, duplicate := added[member]
+		if !present && !duplicate {
+			added[member] = struct{}{}
+			elementBytes += len(member)
+		}
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, len(node.Set)+len(added)))
+	if err != nil {
+		return 0, err
+	}
+
+	for member := range added {
+		node.Set[member] = struct{}{}
+	}
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	return len(added), nil
+}
+
+// SetRemove removes members from the set stored under key, an emptied set is deleted.
+// Returns how many members were removed.
+func (cache *cache) SetRemove(key string, members []string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, setKind, time.Now())
+	if !ok || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if _, ok := node.Set[member]; ok {
+			node.elementBytes -= uint32(len(member))
+			delete(node.Set, member)
+			removed++
+		}
+	}
+
+	if len(node.Set) == 0 {
+		shard.remove(key)
+	} else if removed > 0 {
+		shard.commit(key, node)
+	}
+	return removed, nil
+}
+
+// SetIsMember reports whether member belongs to the set stored under key.
+func (cache *cache) SetIsMember(key, member string) (bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, setKind, time.Now())
+	if !ok || err != nil {
+		return false, err
+	}
+
+	shard.policy.access(key)
+	_, ok = node.Set[member]
+	return ok, nil
+}
+
+// SetMembers returns the members of the set stored under key, sorted.
+func (cache *cache) SetMembers(key string) ([]string, error) {
+	return cache.SetUnion([]string{key})
+}
+
+// SetIntersect returns the members found in every set stored under keys, sorted.
+// A missing key counts as an empty set.
+func (cache *cache) SetIntersect(keys []string) ([]string, error) {
+	sets, err := cache.readSets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	for member := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if _, ok := set[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			members = append(members, member)
+		}
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+// SetUnion returns the members found in any set stored under keys, sorted.
+func (cache *cache) SetUnion(keys []string) ([]string, error) {
+	sets, err := cache.readSets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	union := make(map[string]struct{})
+	for _, set := range sets {
+		for member := range set {
+			union[member] = struct{}{}
+		}
+	}
+
+	members := make([]string, 0, len(union))
+	for member := range union {
+		members = append(members, member)
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+// readSets copies the sets stored under keys at a single point in time,
+// missing keys read as nil sets.
+func (cache *cache) readSets(keys []string) ([]map[string]struct{}, error) {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		shard := cache.shardFor(key)
+		node, ok, err := shard.lookupKind(key, setKind, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			shard.policy.access(key)
+			sets[i] = maps.Clone(node.Set)
+		}
+	}
+	return sets, nil
+}
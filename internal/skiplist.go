@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// Chance of a node reaching the next level
+	skiplistP = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	// Number of nodes passed when following forward, used to compute ranks
+	span int
+}
+
+type skiplistNode struct {
+	member string
+	score  float64
+	levels []skiplistLevel
+}
+
+// before reports whether the node sorts before the member with score
+func (node *skiplistNode) before(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// sortedSet orders its members by score, then by member, in a skiplist
+// giving O(log n) inserts, removals and rank lookups.
+type sortedSet struct {
+	scores map[string]float64
+	header *skiplistNode
+	level  int
+}
+
+type sortedEntry struct {
+	Member string
+	Score  float64
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{
+		scores: make(map[string]float64),
+		header: &skiplistNode{levels: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+func (set *sortedSet) length() int {
+	return len(set.scores)
+}
+
+func (set *sortedSet) score(member string) (float64, bool) {
+	score, ok := set.scores[member]
+	return score, ok
+}
+
+// add sets the score of member. Returns true if the member is new.
+func (set *sortedSet) add(member string, score float64) bool {
+	previous, ok := set.scores[member]
+	if ok {
+		if previous == score {
+			return false
+		}
+		set.unlink(member, previous)
+	}
+
+	set.scores[member] = score
+	set.link(member, score)
+	return !ok
+}
+
+// remove deletes member. Returns false if it wasn't in the set.
+func (set *sortedSet) remove(member string) bool {
+	score, ok := set.scores[member]
+	if !ok {
+		return false
+	}
+
+	delete(set.scores, member)
+	set.unlink(member, score)
+	return true
+}
+
+func (set *sortedSet) link(member string, score float64) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	node := set.header
+	for i := set.level - 1; i >= 0; i-- {
+		if i < set.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for node.levels[i].forward != nil && node.levels[i].forward.before(score, member) {
+			rank[i] += node.levels[i].span
+			node = node.levels[i].forward
+		}
+		update[i] = node
+	}
+
+	level := randomLevel()
+	if level > set.level {
+		for i := set.level; i < level; i++ {
+			update[i] = set.header
+			update[i].levels[i].span = len(set.scores) - 1
+		}
+		set.level = level
+	}
+
+	node = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		node.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = node
+		node.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < set.level; i++ {
+		update[i].levels[i].span++
+	}
+}
+
+func (set *sortedSet) unlink(member string, score float64) {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	node := set.header
+	for i := set.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && node.levels[i].forward.before(score, member) {
+			node = node.levels[i].forward
+		}
+		update[i] = node
+	}
+
+	node = node.levels[0].forward
+	if node == nil || node.member != member {
+		return
+	}
+
+	for i := 0; i < set.level; i++ {
+		if update[i].levels[i].forward == node {
+			update[i].levels[i].span += node.levels[i].span - 1
+			update[i].levels[i].forward = node.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	for set.level > 1 && set.header.levels[set.level-1].forward == nil {
+		set.level--
+	}
+}
+
+// rank returns the 0 based position of member.
+func (set *sortedSet) rank(member string) (int, bool) {
+	score, ok := set.scores[member]
+	if !ok {
+		return 0, false
+	}
+
+	rank := 0
+	node := set.header
+	for i := set.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil &&
+			(node.levels[i].forward.before(score, member) || node.levels[i].forward.member == member) {
+			rank += node.levels[i].span
+			node = node.levels[i].forward
+		}
+		if node.member == member && node != set.header {
+			return rank - 1, true
+		}
+	}
+	return 0, false
+}
+
+// byRank returns the members between the 0 based ranks start and stop inclusive
+func (set *sortedSet) byRank(start, stop int) []sortedEntry {
+	traversed := 0
+	node := set.header
+	for i := set.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && traversed+node.levels[i].span <= start+1 {
+			traversed += node.levels[i].span
+			node = node.levels[i].forward
+		}
+	}
+
+	entries := make([]sortedEntry, 0, stop-start+1)
+	for rank := start; rank <= stop && node != nil; rank++ {
+		entries = append(entries, sortedEntry{Member: node.member, Score: node.score})
+		node = node.levels[0].forward
+	}
+	return entries
+}
+
+// scoreBound is an end of a score range, exclusive ones don't include the score itself
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func (bound scoreBound) above(score float64) bool {
+	return score > bound.score || (!bound.exclusive && score == bound.score)
+}
+
+func (bound scoreBound) below(score float64) bool {
+	return score < bound.score || (!bound.exclusive && score == bound.score)
+}
+
+// parseScoreBound reads a score range end: a number, -inf or +inf, prefixed by '(' to exclude it
+func parseScoreBound(text string) (scoreBound, error) {
+	bound := scoreBound{}
+	if len(text) > 0 && text[0] == '(' {
+		bound.exclusive = true
+		text = text[1:]
+	}
+
+	score, err := strconv.ParseFloat(text, 64)
+	if err != nil || score != score {
+		return bound, fmt.Errorf("min or max is not a float")
+	}
+	bound.score = score
+	return bound, nil
+}
+
+// byScore returns the members with a score between min and max
+func (set *sortedSet) byScore(min, max scoreBound) []sortedEntry {
+	node := set.header
+	for i := set.level - 1; i >= 0; i-- {
+		for node.levels[i].forward != nil && !min.above(node.levels[i].forward.score) {
+			node = node.levels[i].forward
+		}
+	}
+
+	var entries []sortedEntry
+	for node = node.levels[0].forward; node != nil && max.below(node.score); node = node.levels[0].forward {
+		entries = append(entries, sortedEntry{Member: node.member, Score: node.score})
+	}
+	return entries
+}
+
+func (set *sortedSet) entries() []sortedEntry {
+	return set.byRank(0, set.length()-1)
+}
+
+func (set *sortedSet) clone() *sortedSet {
+	clone := newSortedSet()
+	for _, entry := range set.entries() {
+		clone.add(entry.Member, entry.Score)
+	}
+	return clone
+}
+
+// Scores are written as strings since JSON has no infinity
+type sortedSetJSON struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+func (set *sortedSet) MarshalJSON() ([]byte, error) {
+	entries := set.entries()
+	encoded := make([]sortedSetJSON, len(entries))
+	for i, entry := range entries {
+		encoded[i] = sortedSetJSON{Member: entry.Member, Score: formatScore(entry.Score)}
+	}
+	return json.Marshal(encoded)
+}
+
+func (set *sortedSet) UnmarshalJSON(data []byte) error {
+	var encoded []sortedSetJSON
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return err
+	}
+
+	*set = *newSortedSet()
+	for _, entry := range encoded {
+		score, err := strconv.ParseFloat(entry.Score, 64)
+		if err != nil {
+			return err
+		}
+		set.add(entry.Member, score)
+	}
+	return nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
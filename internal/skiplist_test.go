@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// sortedReference is the content of a sorted set in the order the skiplist must keep
+func sortedReference(scores map[string]float64) []sortedEntry {
+	entries := make([]sortedEntry, 0, len(scores))
+	for member, score := range scores {
+		entries = append(entries, sortedEntry{Member: member, Score: score})
+	}
+	slices.SortFunc(entries, func(a, b sortedEntry) int {
+		return cmp.Or(cmp.Compare(a.Score, b.Score), cmp.Compare(a.Member, b.Member))
+	})
+	return entries
+}
+
+func TestSortedSetMatchesReference(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	set := newSortedSet()
+	scores := make(map[string]float64)
+
+	for i := range 5000 {
+		member := fmt.Sprint(random.Intn(300))
+		// few distinct scores so members often tie and sort by name
+		score := float64(random.Intn(20))
+		if random.Intn(3) == 0 {
+			_, exists := scores[member]
+			if set.remove(member) != exists {
+				t.Fatalf("removing %s: reported %t", member, !exists)
+			}
+			delete(scores, member)
+		} else {
+			_, exists := scores[member]
+			if set.add(member, score) == exists {
+				t.Fatalf("adding %s: reported new %t", member, exists)
+			}
+			scores[member] = score
+		}
+
+		if i%250 != 0 {
+			continue
+		}
+		reference := sortedReference(scores)
+		if !slices.Equal(set.entries(), reference) {
+			t.Fatalf("step %d: entries out of order", i)
+		}
+		for rank, entry := range reference {
+			if got, ok := set.rank(entry.Member); !ok || got != rank {
+				t.Fatalf("step %d: rank of %s is %d, expected %d", i, entry.Member, got, rank)
+			}
+		}
+		if len(reference) > 10 && !slices.Equal(set.byRank(5, 9), reference[5:10]) {
+			t.Fatalf("step %d: wrong range by rank", i)
+		}
+	}
+}
+
+func TestSortedSetByScore(t *testing.T) {
+	set := newSortedSet()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		set.add(member, float64(i))
+	}
+	set.add("inf", math.Inf(1))
+
+	tests := []struct {
+		min, max string
+		expected []string
+	}{
+		{"1", "3", []string{"b", "c", "d"}},
+		{"(1", "3", []string{"c", "d"}},
+		{"1", "(3", []string{"b", "c"}},
+		{"-inf", "0", []string{"a"}},
+		{"4", "+inf", []string{"e", "inf"}},
+		{"(4", "(4", nil},
+	}
+
+	for _, test := range tests {
+		min, _ := parseScoreBound(test.min)
+		max, _ := parseScoreBound(test.max)
+		var members []string
+		for _, entry := range set.byScore(min, max) {
+			members = append(members, entry.Member)
+		}
+		if !slices.Equal(members, test.expected) {
+			t.Errorf("[%s, %s]: got %q, expected %q", test.min, test.max, members, test.expected)
+		}
+	}
+
+	if _, err := parseScoreBound("nan"); err == nil {
+		t.Error("NaN was accepted as a score bound")
+	}
+}
+
+func TestSortedSetJSON(t *testing.T) {
+	set := newSortedSet()
+	set.add("low", math.Inf(-1))
+	set.add("mid", 1.5)
+	set.add("high", math.Inf(1))
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := newSortedSet()
+	err = json.Unmarshal(data, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(decoded.entries(), set.entries()) {
+		t.Errorf("got %v after a round trip through %s", decoded.entries(), data)
+	}
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	cache := newTestCache(nil)
+	added, _ := cache.SortedAdd("scores", []string{"ana", "bo", "cy", "ana"}, []float64{3, 1, 2, 5})
+	if added != 3 {
+		t.Errorf("added %d members", added)
+	}
+
+	score, _ := cache.SortedIncrementBy("scores", "bo", 10)
+	if score != 11 {
+		t.Errorf("incremented to %g", score)
+	}
+	if rank, ok, _ := cache.SortedRank("scores", "ana"); !ok || rank != 1 {
+		t.Errorf("ana ranked %d", rank)
+	}
+
+	entries, _ := cache.SortedRange("scores", -2, -1)
+	if len(entries) != 2 || entries[0].Member != "ana" || entries[1].Member != "bo" {
+		t.Errorf("last two members are %v", entries)
+	}
+
+	removed, _ := cache.SortedRemove("scores", []string{"ana", "bo", "cy", "nobody"})
+	if removed != 3 || cache.Size() != 0 {
+		t.Errorf("removed %d members, %d keys left", removed, cache.Size())
+	}
+}
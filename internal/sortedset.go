@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// newSortedSetNode returns an empty sorted set with the default time to live
+func (cache *cache) newSortedSetNode(now time.Time) cacheNode {
+	return cacheNode{
+		Kind:   zsetKind,
+		ZSet:   newSortedSet(),
+		Expiry: expiryFrom(now, cache.defaultTimeToLive()),
+	}
+}
+
+// SortedAdd sets the score of every member to the score at the same index, creating
+// the sorted set if needed. Returns how many members were added.
+func (cache *cache) SortedAdd(key string, members []string, scores []float64) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, zsetKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cache.newSortedSetNode(now)
+	}
+
+	pending := make(map[string]float64, len(members))
+	for i, member := range members {
+		pending[member] = scores[i]
+	}
+	elementBytes, added := int(node.elementBytes), 0
+	for member := range pending {
+		if _, ok := node.ZSet.score(member); !ok {
+			elementBytes += len(member) + scoreBytes
+			added++
+		}
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, node.ZSet.length()+added))
+	if err != nil {
+		return 0, err
+	}
+
+	for member, score := range pending {
+		node.ZSet.add(member, score)
+	}
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	return added, nil
+}
+
+// SortedIncrementBy adds delta to the score of member, a missing member starts at 0.
+func (cache *cache) SortedIncrementBy(key, member string, delta float64) (float64, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	now := time.Now()
+	node, exists, err := shard.lookupKind(key, zsetKind, now)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		node = cache.newSortedSetNode(now)
+	}
+
+	score, ok := node.ZSet.score(member)
+	score += delta
+	if math.IsNaN(score) {
+		return 0, fmt.Errorf("resulting score is not a number")
+	}
+
+	elementBytes, elements := int(node.elementBytes), node.ZSet.length()
+	if !ok {
+		elementBytes += len(member) + scoreBytes
+		elements++
+	}
+
+	err = cache.checkDataSize(key, elementBytes)
+	if err != nil {
+		return 0, err
+	}
+	err = shard.makeRoom(key, nodeByteSize(key, elementBytes, elements))
+	if err != nil {
+		return 0, err
+	}
+
+	node.ZSet.add(member, score)
+	node.elementBytes = uint32(elementBytes)
+	shard.commit(key, node)
+	return score, nil
+}
+
+// SortedRemove removes members from the sorted set stored under key, an emptied set is deleted.
+// Returns how many members were removed.
+func (cache *cache) SortedRemove(key string, members []string) (int, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, zsetKind, time.Now())
+	if !ok || err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if node.ZSet.remove(member) {
+			node.elementBytes -= uint32(len(member) + scoreBytes)
+			removed++
+		}
+	}
+
+	if node.ZSet.length() == 0 {
+		shard.remove(key)
+	} else if removed > 0 {
+		shard.commit(key, node)
+	}
+	return removed, nil
+}
+
+// SortedRange returns the members of the sorted set stored under key between the
+// ranks start and stop inclusive, negative ones counting from the highest score.
+func (cache *cache) SortedRange(key string, start, stop int) ([]sortedEntry, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, zsetKind, time.Now())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	shard.policy.access(key)
+	start, stop, ok = listRange(node.ZSet.length(), start, stop)
+	if !ok {
+		return nil, nil
+	}
+	return node.ZSet.byRank(start, stop), nil
+}
+
+// SortedRangeByScore returns the members of the sorted set stored under key with a score between min and max.
+func (cache *cache) SortedRangeByScore(key string, min, max scoreBound) ([]sortedEntry, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, zsetKind, time.Now())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	shard.policy.access(key)
+	return node.ZSet.byScore(min, max), nil
+}
+
+// SortedRank returns the 0 based position of member, ordered by ascending score.
+func (cache *cache) SortedRank(key, member string) (int, bool, error) {
+	shard := cache.shardFor(key)
+	shard.Mutex.Lock()
+	defer shard.Mutex.Unlock()
+
+	node, ok, err := shard.lookupKind(key, zsetKind, time.Now())
+	if !ok || err != nil {
+		return 0, false, err
+	}
+
+	shard.policy.access(key)
+	rank, ok := node.ZSet.rank(member)
+	return rank, ok, nil
+}
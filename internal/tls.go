@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// tlsConfig serves connections over TLS in place of the built in key exchange
+type tlsConfig struct {
+	// PEM files of the certificate presented by the server and its private key
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// PEM file of the CAs client certificates are verified against, enables client certificates
+	ClientCAFile string `json:"clientCAFile"`
+	// Refuse connections without a valid client certificate
+	RequireClientCert bool `json:"requireClientCert"`
+	// Lowest TLS version accepted: 1.2 or 1.3 (DEFAULT 1.2)
+	MinVersion string `json:"minVersion"`
+	// Users authenticated by the common name of a verified client certificate, without AUTH
+	Users map[string]string `json:"users"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverConfig loads the certificates into a crypto/tls server configuration
+func (config *tlsConfig) serverConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load TLS certificate: %s", err)
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s', expected 1.2 or 1.3", config.MinVersion)
+		}
+		serverConfig.MinVersion = version
+	}
+
+	if config.ClientCAFile == "" {
+		if config.RequireClientCert || len(config.Users) > 0 {
+			return nil, fmt.Errorf("client certificates need a clientCAFile to be verified against")
+		}
+		return serverConfig, nil
+	}
+
+	authorities, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read client CA file: %s", err)
+	}
+	serverConfig.ClientCAs = x509.NewCertPool()
+	if !serverConfig.ClientCAs.AppendCertsFromPEM(authorities) {
+		return nil, fmt.Errorf("no certificate found in client CA file '%s'", config.ClientCAFile)
+	}
+
+	serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return serverConfig, nil
+}
+
+// certificateUser returns the user mapped to the verified client certificate of a connection
+func (config *tlsConfig) certificateUser(state tls.ConnectionState) (string, bool) {
+	if len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	user, ok := config.Users[state.VerifiedChains[0][0].Subject.CommonName]
+	return user, ok
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate for commonName signed by parent, self signed without one
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+func (certificate *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{certificate.der}, PrivateKey: certificate.key}
+}
+
+// writePEM saves the certificate and its key in directory, returning both paths
+func (certificate *testCertificate) writePEM(t *testing.T, directory, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(certificate.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(directory, name+".pem"), filepath.Join(directory, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// tlsRequest sends a V2 request over a new TLS connection presenting certificate, if any,
+// and returns the reply or the error the connection failed with
+func tlsRequest(t *testing.T, lebreServer *LebreServer, authority *testCertificate, certificate *testCertificate, args ...string) (string, error) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.certificate)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if certificate != nil {
+		// presented even when the server doesn't list its CA as acceptable
+		clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			presented := certificate.tlsCertificate()
+			return &presented, nil
+		}
+	}
+
+	conn, err := tls.Dial("tcp", lebreServer.address(), clientConfig)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := v2Request(args...)
+	_, err = conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(request))), request...))
+	if err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(conn)
+	length := make([]byte, 4)
+	_, err = io.ReadFull(reader, length)
+	if err != nil {
+		return "", err
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(length))
+	_, err = io.ReadFull(reader, reply)
+	return string(reply), err
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	directory := t.TempDir()
+	authority := newTestCertificate(t, "Lebre Test CA", nil)
+	server := newTestCertificate(t, "127.0.0.1", authority)
+	mapped := newTestCertificate(t, "nightly-cron", authority)
+	unmapped := newTestCertificate(t, "someone-else", authority)
+	// signed by a CA the server doesn't trust
+	unknown := newTestCertificate(t, "nightly-cron", newTestCertificate(t, "Other CA", nil))
+
+	certFile, keyFile := server.writePEM(t, directory, "server")
+	authorityFile, _ := authority.writePEM(t, directory, "ca")
+
+	for _, required := range []bool{false, true} {
+		lebreServer := startTestServer(t, func(serverConfig *ServerConfig) {
+			serverConfig.TLS = &tlsConfig{
+				CertFile:          certFile,
+				KeyFile:           keyFile,
+				ClientCAFile:      authorityFile,
+				RequireClientCert: required,
+				Users:             map[string]string{"nightly-cron": testUser},
+			}
+		})
+
+		tests := []struct {
+			name        string
+			certificate *testCertificate
+			expected    string
+			refused     bool
+		}{
+			{"mapped certificate", mapped, "NOT_FOUND", false},
+			{"unmapped certificate", unmapped, "ERR unauthorized", false},
+			{"unknown certificate", unknown, "", true},
+			{"no certificate", nil, "ERR unauthorized", required},
+		}
+		for _, test := range tests {
+			reply, err := tlsRequest(t, lebreServer, authority, test.certificate, "GET", "key")
+			if test.refused {
+				if err == nil {
+					t.Errorf("required %t, %s: the connection was accepted and replied %q", required, test.name, reply)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("required %t, %s: %s", required, test.name, err)
+				continue
+			}
+			expectReply(t, test.name, reply, test.expected)
+		}
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	directory := t.TempDir()
+	authority := newTestCertificate(t, "Lebre Test CA", nil)
+	certFile, keyFile := newTestCertificate(t, "127.0.0.1", authority).writePEM(t, directory, "server")
+	authorityFile, _ := authority.writePEM(t, directory, "ca")
+
+	tests := []struct {
+		name   string
+		config tlsConfig
+	}{
+		{"missing certificate", tlsConfig{CertFile: filepath.Join(directory, "missing.pem"), KeyFile: keyFile}},
+		{"unknown version", tlsConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.1"}},
+		{"users without a CA", tlsConfig{CertFile: certFile, KeyFile: keyFile, Users: map[string]string{"a": testUser}}},
+		{"required without a CA", tlsConfig{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}},
+		{"CA file without certificates", tlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}},
+	}
+	for _, test := range tests {
+		if _, err := test.config.serverConfig(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	valid := tlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: authorityFile, MinVersion: "1.3"}
+	serverConfig, err := valid.serverConfig()
+	if err != nil || serverConfig.MinVersion != tls.VersionTLS13 || serverConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("got %+v, %v", serverConfig, err)
+	}
+}
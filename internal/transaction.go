@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// transaction is a MULTI block being queued on a connection
+type transaction struct {
+	queued [][]string
+}
+
+// Verbs that can't be queued in a transaction
+var nonTransactionalVerbs = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"BLPOP":        true,
+	"BRPOP":        true,
+}
+
+// dispatch runs a request for session. Transaction verbs are handled here,
+// any other verb is queued while a transaction is open or executed right away.
+func (lebreServer *LebreServer) dispatch(session *session, requestParts []string) string {
+	commandParts := requestParts[1:]
+
+	switch commandParts[0] {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		session.logger.Log(fmt.Sprintf("[REQUEST]: %s", strings.Join(requestParts, " ")))
+		if !session.authorized {
+			return "ERR unauthorized"
+		}
+	}
+
+	switch commandParts[0] {
+	case "MULTI":
+		if session.transaction != nil {
+			return "ERR MULTI calls can not be nested"
+		}
+		session.transaction = &transaction{}
+		return "OK"
+
+	case "EXEC":
+		if session.transaction == nil {
+			return "ERR EXEC without MULTI"
+		}
+		return lebreServer.exec(session)
+
+	case "DISCARD":
+		if session.transaction == nil {
+			return "ERR DISCARD without MULTI"
+		}
+		session.transaction = nil
+		session.watched = nil
+		return "OK"
+
+	case "WATCH":
+		if session.transaction != nil {
+			return "ERR WATCH inside MULTI is not allowed"
+		}
+		if len(commandParts) < 2 {
+			return "ERR wrong number of arguments for WATCH"
+		}
+		if session.watched == nil {
+			session.watched = make(map[string]uint64)
+		}
+		versions := lebreServer.cache.Versions(commandParts[1:])
+		for i, key := range commandParts[1:] {
+			// a key keeps the version it had when first watched
+			if _, ok := session.watched[key]; !ok {
+				session.watched[key] = versions[i]
+			}
+		}
+		return "OK"
+
+	case "UNWATCH":
+		session.watched = nil
+		return "OK"
+	}
+
+	if session.transaction != nil {
+		if nonTransactionalVerbs[commandParts[0]] {
+			return fmt.Sprintf("ERR %s is not allowed in a transaction", commandParts[0])
+		}
+		session.transaction.queued = append(session.transaction.queued, requestParts)
+		return "QUEUED"
+	}
+
+	// blocking pops only hold the transaction gate while popping, not while they wait
+	if commandParts[0] == "BLPOP" || commandParts[0] == "BRPOP" {
+		return lebreServer.execute(session, requestParts)
+	}
+
+	// scripts run alone like transactions
+	if commandParts[0] == "EVAL" || commandParts[0] == "EVALSHA" {
+		lebreServer.cache.lockGates()
+		defer lebreServer.cache.unlockGates()
+		return lebreServer.execute(session, requestParts)
+	}
+
+	// any gate keeps transactions out, the one of the first key spreads
+	// requests over the gates like over the shards
+	gateKey := commandParts[0]
+	if len(commandParts) > 1 {
+		gateKey = commandParts[1]
+	}
+	gate := lebreServer.cache.enterGate(gateKey)
+	defer gate.RUnlock()
+	return lebreServer.execute(session, requestParts)
+}
+
+// exec runs the queued transaction of session with no other request interleaved.
+// Nothing runs if a watched key changed since it was watched.
+func (lebreServer *LebreServer) exec(session *session) string {
+	queued, watched := session.transaction.queued, session.watched
+	session.transaction, session.watched = nil, nil
+
+	lebreServer.cache.lockGates()
+	defer lebreServer.cache.unlockGates()
+
+	if len(watched) > 0 {
+		keys := make([]string, 0, len(watched))
+		for key := range watched {
+			keys = append(keys, key)
+		}
+		for i, version := range lebreServer.cache.Versions(keys) {
+			if version != watched[keys[i]] {
+				return "ABORTED"
+			}
+		}
+	}
+
+	replies := make([]string, len(queued))
+	for i, requestParts := range queued {
+		replies[i] = lebreServer.execute(session, requestParts)
+	}
+	return resultsReply(replies)
+}
+
+// Versions returns the current version of every key. A missing key has the
+// version of the last removal in its removal slot, so it changes if the key
+// is created and removed again, and rarely when another key of the slot is.
+func (cache *cache) Versions(keys []string) []uint64 {
+	shards := cache.lockShards(keys)
+	defer unlockShards(shards)
+
+	now := time.Now()
+	versions := make([]uint64, len(keys))
+	for i, key := range keys {
+		shard := cache.shardFor(key)
+		if node, ok := shard.lookup(key, now); ok {
+			versions[i] = node.Version
+		} else {
+			versions[i] = shard.removals[removalSlot(key)]
+		}
+	}
+	return versions
+}
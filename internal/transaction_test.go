@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	lebreServer := startTestServer(t, nil)
+	client := dialTestServer(t, lebreServer)
+
+	expectReply(t, "MULTI", client.do("MULTI"), "OK")
+	expectReply(t, "SET", client.do("SET", "balance", "10"), "QUEUED")
+	expectReply(t, "INCRBY", client.do("INCRBY", "balance", "5"), "QUEUED")
+	expectReply(t, "BLPOP", client.do("BLPOP", "list", "0"), "ERR BLPOP is not allowed in a transaction")
+	expectReply(t, "EXEC", client.do("EXEC"), "RESULTS 2 $2 OK $10 INTEGER 15")
+	expectReply(t, "EXEC", client.do("EXEC"), "ERR EXEC without MULTI")
+
+	expectReply(t, "MULTI", client.do("MULTI"), "OK")
+	client.do("DELETE", "balance")
+	expectReply(t, "DISCARD", client.do("DISCARD"), "OK")
+	expectReply(t, "GET", client.do("GET", "balance"), "VALUE 15")
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    []string
+		changes  [][]string
+		expected string
+	}{
+		{"untouched key", []string{"SET", "key", "a"}, nil, "RESULTS 1 $2 OK"},
+		{"written key", []string{"SET", "key", "a"}, [][]string{{"SET", "key", "b"}}, "ABORTED"},
+		{"deleted key", []string{"SET", "key", "a"}, [][]string{{"DELETE", "key"}}, "ABORTED"},
+		{"untouched missing key", nil, nil, "RESULTS 1 $2 OK"},
+		{"created key", nil, [][]string{{"SET", "key", "b"}}, "ABORTED"},
+		{"created and deleted key", nil, [][]string{{"SET", "key", "b"}, {"DELETE", "key"}}, "ABORTED"},
+	}
+
+	for _, test := range tests {
+		lebreServer := startTestServer(t, nil)
+		client := dialTestServer(t, lebreServer)
+		other := dialTestServer(t, lebreServer)
+
+		if test.setup != nil {
+			client.do(test.setup...)
+		}
+		client.do("WATCH", "key")
+		for _, change := range test.changes {
+			other.do(change...)
+		}
+		client.do("MULTI")
+		client.do("SET", "result", "done")
+		expectReply(t, test.name, client.do("EXEC"), test.expected)
+	}
+}
+
+func TestTransactionGates(t *testing.T) {
+	lebreServer := &LebreServer{cache: newTestCache(nil)}
+	session := &session{logger: NewCli(), authorized: true}
+	// requests keyed to different shards than the one held below
+	keys := []string{keysInShard(lebreServer.cache, 1, 1, "a")[0], keysInShard(lebreServer.cache, 2, 1, "b")[0]}
+
+	finished := func(run func()) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			run()
+		}()
+		return done
+	}
+	blocked := func(done <-chan struct{}) bool {
+		select {
+		case <-done:
+			return false
+		case <-time.After(20 * time.Millisecond):
+			return true
+		}
+	}
+
+	// a transaction keeps out requests on every shard
+	lebreServer.cache.lockGates()
+	request := finished(func() {
+		lebreServer.dispatch(session, []string{protocolV2, "MGET", keys[0], keys[1]})
+	})
+	if !blocked(request) {
+		t.Error("a request ran during a transaction")
+	}
+	lebreServer.cache.unlockGates()
+	<-request
+
+	// requests on other shards don't wait for each other, a transaction waits for them
+	gate := lebreServer.cache.enterGate(keysInShard(lebreServer.cache, 0, 1, "c")[0])
+	request = finished(func() {
+		lebreServer.dispatch(session, []string{protocolV2, "SET", keys[0], "value"})
+	})
+	if blocked(request) {
+		t.Error("a request waited on a request keyed to another shard")
+	}
+	transaction := finished(lebreServer.cache.lockGates)
+	if !blocked(transaction) {
+		t.Error("a transaction ran while a request was running")
+	}
+	gate.RUnlock()
+	<-transaction
+	lebreServer.cache.unlockGates()
+}
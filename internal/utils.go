@@ -1,14 +1,139 @@
 package internal
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
-func Interval(interval time.Duration, task func()) {
+// Interval runs task on every tick until done is closed
+func Interval(interval time.Duration, done <-chan struct{}, task func()) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			task()
+		case <-done:
+			return
 		}
 	}
 }
+
+// hashKey is the 64-bit FNV-1a hash of key
+func hashKey(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// isLoopback reports whether addr is a TCP address on a loopback interface
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// mix64 is the murmur3 finalizer, it spreads every bit of hash over the whole
+// result where FNV-1a leaves the high bits poorly mixed
+func mix64(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// globMatch reports whether s matches the glob pattern. It supports '*' for any
+// sequence, '?' for any single byte, '[abc]', '[a-z]' and '[^abc]' classes, and
+// '\' to escape the next byte. Unlike path.Match, '*' also matches '/'.
+func globMatch(pattern, s string) bool {
+	// position to resume from when the last '*' has to absorb one more byte
+	starPattern, starString := -1, 0
+	p, i := 0, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starString = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, next, ok := matchClass(pattern, p, s[i]); ok && matched {
+					p = next
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		if starPattern < 0 {
+			return false
+		}
+		starString++
+		p, i = starPattern+1, starString
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the character class starting at pattern[start].
+// Returns whether it matched, the index right after the class, and false if the
+// class is never closed.
+func matchClass(pattern string, start int, c byte) (bool, int, bool) {
+	p := start + 1
+	negated := false
+	if p < len(pattern) && (pattern[p] == '^' || pattern[p] == '!') {
+		negated = true
+		p++
+	}
+
+	matched := false
+	for first := true; p < len(pattern) && (first || pattern[p] != ']'); first = false {
+		low := pattern[p]
+		if low == '\\' && p+1 < len(pattern) {
+			p++
+			low = pattern[p]
+		}
+		high := low
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			high = pattern[p+2]
+			if high == '\\' && p+3 < len(pattern) {
+				p++
+				high = pattern[p+2]
+			}
+			p += 2
+		}
+		if low <= c && c <= high {
+			matched = true
+		}
+		p++
+	}
+
+	if p >= len(pattern) {
+		return false, start, false
+	}
+	return matched != negated, p + 1, true
+}